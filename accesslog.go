@@ -0,0 +1,258 @@
+package kyache
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat selects the line format of an AccessLog.
+type AccessLogFormat int
+
+const (
+	// AccessLogCombined writes the Apache Combined format followed by the
+	// request duration in seconds, the cache result, the upstream status
+	// and the upstream latency in seconds. Missing values are "-".
+	AccessLogCombined AccessLogFormat = iota
+	// AccessLogJSON writes one JSON object per line.
+	AccessLogJSON
+)
+
+// Cache results shown in the access log.
+const (
+	resultHit         = "HIT"
+	resultMiss        = "MISS"
+	resultStale       = "STALE"
+	resultBypass      = "BYPASS"
+	resultRevalidated = "REVALIDATED"
+)
+
+func setResult(ctx context.Context, result string) {
+	if ex := exchangeFrom(ctx); ex != nil {
+		ex.result = result
+	}
+}
+
+// AccessLog writes a line for every request a CacheServer's Handler serves.
+// It is safe for concurrent use.
+type AccessLog struct {
+	format AccessLogFormat
+
+	mu     sync.Mutex
+	w      io.Writer
+	path   string
+	file   *os.File
+	hup    chan os.Signal
+	closed bool
+	// logger receives reopen failures. New sets it to Config.Logger.
+	logger *slog.Logger
+}
+
+// NewAccessLog writes access log lines to w.
+func NewAccessLog(w io.Writer, format AccessLogFormat) *AccessLog {
+	return &AccessLog{format: format, w: w}
+}
+
+// OpenAccessLog appends access log lines to the file at path. On Unix
+// systems the file is reopened when the process receives SIGHUP, so it can
+// be rotated by renaming it and signalling kyache.
+func OpenAccessLog(path string, format AccessLogFormat) (*AccessLog, error) {
+	al := &AccessLog{format: format, path: path}
+	if err := al.Reopen(); err != nil {
+		return nil, err
+	}
+	al.reopenOnSignal()
+	return al, nil
+}
+
+// reopen is Reopen for a signal, which has nobody to return an error to.
+func (al *AccessLog) reopen() {
+	if err := al.Reopen(); err != nil {
+		al.mu.Lock()
+		logger := al.logger
+		al.mu.Unlock()
+		if logger == nil {
+			logger = slog.Default()
+		}
+		logger.Error("reopening access log failed", slog.String("path", al.path), slog.String(logError, err.Error()))
+	}
+}
+
+func (al *AccessLog) setLogger(logger *slog.Logger) {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.logger = logger
+}
+
+// Reopen reopens the file of an AccessLog made by OpenAccessLog. Lines
+// written meanwhile go to the old file until the new one is open.
+func (al *AccessLog) Reopen() error {
+	if al.path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	al.mu.Lock()
+	if al.closed {
+		al.mu.Unlock()
+		return f.Close()
+	}
+	old := al.file
+	al.file, al.w = f, f
+	al.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Close stops reopening on SIGHUP and closes the file, if the AccessLog
+// has one. Lines logged afterwards are dropped.
+func (al *AccessLog) Close() error {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.closed {
+		return nil
+	}
+	al.closed = true
+	al.stopReopenOnSignal()
+	if al.file == nil {
+		al.w = io.Discard
+		return nil
+	}
+	err := al.file.Close()
+	al.file, al.w = nil, io.Discard
+	return err
+}
+
+// accessEntry is one access log line. Its fields are also the keys of the
+// JSON format.
+type accessEntry struct {
+	Time            time.Time `json:"time"`
+	Client          string    `json:"client"`
+	Method          string    `json:"method"`
+	URL             string    `json:"url"`
+	Proto           string    `json:"proto"`
+	Status          int       `json:"status"`
+	Bytes           int64     `json:"bytes"`
+	Duration        float64   `json:"duration"`
+	Cache           string    `json:"cache,omitempty"`
+	UpstreamStatus  int       `json:"upstream_status,omitempty"`
+	UpstreamLatency float64   `json:"upstream_latency,omitempty"`
+	Referer         string    `json:"referer,omitempty"`
+	UserAgent       string    `json:"user_agent,omitempty"`
+}
+
+func (al *AccessLog) log(r *http.Request, lw *loggingWriter, ex *exchange) {
+	e := accessEntry{
+		Time:      ex.start,
+		Client:    r.RemoteAddr,
+		Method:    r.Method,
+		URL:       r.URL.RequestURI(),
+		Proto:     r.Proto,
+		Status:    lw.status,
+		Bytes:     lw.bytes,
+		Duration:  time.Since(ex.start).Seconds(),
+		Cache:     ex.result,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.Client = host
+	}
+	if e.Status == 0 {
+		e.Status = http.StatusOK
+	}
+	if ex.originLatency != 0 {
+		e.UpstreamStatus = ex.originStatus
+		e.UpstreamLatency = ex.originLatency.Seconds()
+	}
+
+	var line []byte
+	if al.format == AccessLogJSON {
+		line, _ = json.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = e.appendCombined(nil)
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.w.Write(line)
+}
+
+func (e *accessEntry) appendCombined(b []byte) []byte {
+	b = append(b, e.Client...)
+	b = append(b, " - - ["...)
+	b = e.Time.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(b, "] "...)
+	b = strconv.AppendQuote(b, e.Method+" "+e.URL+" "+e.Proto)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(e.Status), 10)
+	b = append(b, ' ')
+	b = appendDash(b, e.Bytes != 0, func(b []byte) []byte { return strconv.AppendInt(b, e.Bytes, 10) })
+	b = append(b, ' ')
+	b = strconv.AppendQuote(b, orDash(e.Referer))
+	b = append(b, ' ')
+	b = strconv.AppendQuote(b, orDash(e.UserAgent))
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, e.Duration, 'f', 3, 64)
+	b = append(b, ' ')
+	b = append(b, orDash(e.Cache)...)
+	b = append(b, ' ')
+	b = appendDash(b, e.UpstreamStatus != 0, func(b []byte) []byte { return strconv.AppendInt(b, int64(e.UpstreamStatus), 10) })
+	b = append(b, ' ')
+	b = appendDash(b, e.UpstreamLatency != 0, func(b []byte) []byte { return strconv.AppendFloat(b, e.UpstreamLatency, 'f', 3, 64) })
+	return append(b, '\n')
+}
+
+func appendDash(b []byte, ok bool, appendValue func([]byte) []byte) []byte {
+	if !ok {
+		return append(b, '-')
+	}
+	return appendValue(b)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// loggingWriter records the status and body size of a response for the
+// access log. Unwrap lets http.ResponseController reach the underlying
+// writer for flushing.
+type loggingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (lw *loggingWriter) WriteHeader(status int) {
+	if lw.status == 0 && status >= 200 {
+		lw.status = status
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *loggingWriter) Write(p []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	n, err := lw.ResponseWriter.Write(p)
+	lw.bytes += int64(n)
+	return n, err
+}
+
+func (lw *loggingWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
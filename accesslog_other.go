@@ -0,0 +1,8 @@
+//go:build !unix
+
+package kyache
+
+// Without SIGHUP the file is only reopened by calling Reopen.
+func (al *AccessLog) reopenOnSignal() {}
+
+func (al *AccessLog) stopReopenOnSignal() {}
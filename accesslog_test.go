@@ -0,0 +1,60 @@
+package kyache
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogCombined(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	})
+	var buf bytes.Buffer
+	handler := New(&Config{AccessLog: NewAccessLog(&buf, AccessLogCombined)}).Handler(originURL)
+	for range 2 {
+		req := httptest.NewRequest("GET", "/obj?q=1", nil)
+		req.Header.Set("User-Agent", "test-agent")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/form", nil))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3:\n%s", len(lines), buf.String())
+	}
+	patterns := []string{
+		`^192\.0\.2\.1 - - \[[^\]]+\] "GET /obj\?q=1 HTTP/1\.1" 200 4 "-" "test-agent" \d+\.\d{3} MISS 200 \d+\.\d{3}$`,
+		`^192\.0\.2\.1 - - \[[^\]]+\] "GET /obj\?q=1 HTTP/1\.1" 200 4 "-" "test-agent" \d+\.\d{3} HIT - -$`,
+		`^192\.0\.2\.1 - - \[[^\]]+\] "POST /form HTTP/1\.1" 200 4 "-" "-" \d+\.\d{3} BYPASS 200 \d+\.\d{3}$`,
+	}
+	for i, pattern := range patterns {
+		if !regexp.MustCompile(pattern).MatchString(lines[i]) {
+			t.Errorf("line %d = %q, want match for %s", i, lines[i], pattern)
+		}
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	})
+	var buf bytes.Buffer
+	handler := New(&Config{AccessLog: NewAccessLog(&buf, AccessLogJSON)}).Handler(originURL)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/obj", nil))
+
+	var entry accessEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("decoding %q: %v", buf.String(), err)
+	}
+	if entry.Client != "192.0.2.1" || entry.Method != "GET" || entry.URL != "/obj" || entry.Status != 200 ||
+		entry.Bytes != 4 || entry.Cache != "MISS" || entry.UpstreamStatus != 200 || entry.UpstreamLatency <= 0 {
+		t.Errorf("entry = %+v", entry)
+	}
+}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package kyache
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reopenOnSignal reopens the file whenever the process receives SIGHUP.
+func (al *AccessLog) reopenOnSignal() {
+	al.hup = make(chan os.Signal, 1)
+	signal.Notify(al.hup, syscall.SIGHUP)
+	go func() {
+		for range al.hup {
+			al.reopen()
+		}
+	}()
+}
+
+// stopReopenOnSignal undoes reopenOnSignal. al.mu must be held.
+func (al *AccessLog) stopReopenOnSignal() {
+	if al.hup != nil {
+		signal.Stop(al.hup)
+		close(al.hup)
+	}
+}
@@ -0,0 +1,51 @@
+//go:build unix
+
+package kyache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAccessLogReopensOnSIGHUP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	al, err := OpenAccessLog(path, AccessLogCombined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+	handler := New(&Config{AccessLog: al}).Handler(newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/before", nil))
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("log file was not reopened")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/after", nil))
+
+	for name, want := range map[string]string{path + ".1": "/before", path: "/after"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), want) || strings.Count(string(data), "\n") != 1 {
+			t.Errorf("%s = %q, want one line for %s", name, data, want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package kyache
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+const methodPurge = "PURGE"
+
+func (cs *CacheServer) registerAdminPaths() {
+	cs.RegisterPath("/admin/snapshot", cs.handleSnapshot)
+	cs.RegisterPath("/admin/purge", cs.handlePurge)
+	cs.RegisterPath("/admin/generation", cs.handleGeneration)
+	cs.RegisterPath("/admin/ban", cs.handleBan)
+	cs.RegisterPath("/admin/entries", cs.handleEntries)
+	cs.RegisterPath("/admin/entry", cs.handleEntry)
+	cs.RegisterPath("/admin/events", cs.handleEvents)
+}
+
+// Snapshot writes every stored response to w as a portable archive and
+// returns how many entries were written. Entries of outdated generations
+// that have not been swept yet are left out.
+func (cs *CacheServer) Snapshot(w io.Writer) (int, error) {
+	return cache.WriteSnapshot(w, currentEntries{Store: cs.cacheStore, generations: cs.generations})
+}
+
+// Restore loads an archive written by Snapshot. StoredAt and InitialAge are
+// kept, so restored entries age as if they had never left the cache. The
+// generations of the restored keys are picked up as in New, and entries
+// they leave outdated are swept.
+func (cs *CacheServer) Restore(r io.Reader) (int, error) {
+	n, err := cache.ReadSnapshot(r, cs.cacheStore)
+	cs.generations.recover(cs.cacheStore)
+	cs.generationSweep.trigger()
+	return n, err
+}
+
+// currentEntries ranges over the entries of the current generations only.
+type currentEntries struct {
+	cache.Store
+	generations *generations
+}
+
+func (s currentEntries) Range(fn func(key string, resp *cache.CachedResponse) bool) {
+	s.Store.Range(func(key string, resp *cache.CachedResponse) bool {
+		if s.generations.outdated(key) {
+			return true
+		}
+		return fn(key, resp)
+	})
+}
+
+// GET downloads a snapshot, PUT or POST restores one from the request body.
+func (cs *CacheServer) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="kyache.snapshot"`)
+		if n, err := cs.Snapshot(w); err != nil {
+			cs.logger.Error("snapshot failed", slog.Int("entries", n), slog.String(logError, err.Error()))
+		}
+	case http.MethodPut, http.MethodPost:
+		n, err := cs.Restore(r.Body)
+		if err != nil {
+			cs.logger.Error("restore failed", slog.Int("entries", n), slog.String(logError, err.Error()))
+			http.Error(w, fmt.Sprintf("restore failed after %d entries: %v", n, err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"restored":%d}`, n)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handlePurge removes the entries selected by one of the url, prefix, host
+// or tag query parameters, or marks them stale if soft is true.
+func (cs *CacheServer) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete && r.Method != methodPurge {
+		w.Header().Set("Allow", "POST, DELETE, PURGE")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	soft, _ := strconv.ParseBool(query.Get("soft"))
+	var keys []string
+	switch {
+	case query.Has("url"):
+		keys = cs.matchingKeys(matchURL(query.Get("url")))
+	case query.Has("prefix"):
+		keys = cs.matchingKeys(matchPrefix(query.Get("prefix")))
+	case query.Has("host"):
+		keys = cs.matchingKeys(matchHost(query.Get("host")))
+	case query.Has("tag"):
+		cs.indexed.load()
+		keys = cs.indexed.index.lookup(query.Get("tag"))
+	default:
+		http.Error(w, "one of url, prefix, host or tag is required", http.StatusBadRequest)
+		return
+	}
+	writePurged(w, cs.purgeKeys(keys, soft))
+}
+
+// handlePurgeMethod answers "PURGE /path" sent to the proxy itself by
+// purging that URL on the origin. A Soft-Purge: 1 header asks for a soft
+// purge.
+func (cs *CacheServer) handlePurgeMethod(w http.ResponseWriter, r *http.Request, originURL *url.URL) {
+	keys := cs.matchingKeys(matchURL(originTarget(r, originURL)))
+	writePurged(w, cs.purgeKeys(keys, r.Header.Get("Soft-Purge") == "1"))
+}
+
+func writePurged(w http.ResponseWriter, purged int) {
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"purged":%d}`, purged)
+}
+
+// handleGeneration reports the current cache generation on GET and starts a
+// new one on POST, for the host query parameter or for every host.
+func (cs *CacheServer) handleGeneration(w http.ResponseWriter, r *http.Request) {
+	host := r.URL.Query().Get("host")
+	var generation uint64
+	switch r.Method {
+	case http.MethodGet:
+		generation = cs.generations.current(host)
+	case http.MethodPost:
+		if host == "" {
+			generation = cs.BumpGeneration()
+		} else {
+			generation = cs.BumpHostGeneration(host)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"generation":%d}`, generation)
+}
+
+// handleBan adds the ban expression in the request body on POST, and lists
+// the bans in effect.
+func (cs *CacheServer) handleBan(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		expr, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		if err != nil {
+			http.Error(w, "Reading ban failed", http.StatusBadRequest)
+			return
+		}
+		if err := cs.Ban(strings.TrimSpace(string(expr))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, map[string][]string{"bans": cs.Bans()})
+}
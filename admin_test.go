@@ -0,0 +1,53 @@
+package kyache
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+func TestSnapshotEndpointRoundTrip(t *testing.T) {
+	originURL, _ := url.Parse("http://example.com")
+	src := New(&Config{EnableAdmin: true})
+	storedAt := time.Now().Add(-time.Minute)
+	src.cacheStore.Set("http://example.com/a", &cache.CachedResponse{
+		StatusCode:     http.StatusOK,
+		RequestHeader:  http.Header{},
+		ResponseHeader: http.Header{"Cache-Control": []string{"max-age=600"}},
+		Body:           []byte("warm"),
+		StoredAt:       storedAt,
+	})
+
+	w := httptest.NewRecorder()
+	src.Handler(originURL).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/snapshot", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("snapshot status = %d, want 200", w.Code)
+	}
+
+	dst := New(&Config{EnableAdmin: true})
+	w2 := httptest.NewRecorder()
+	dst.Handler(originURL).ServeHTTP(w2, httptest.NewRequest(http.MethodPut, "/admin/snapshot", bytes.NewReader(w.Body.Bytes())))
+	if w2.Code != http.StatusOK || w2.Body.String() != `{"restored":1}` {
+		t.Fatalf("restore = %d %q", w2.Code, w2.Body.String())
+	}
+
+	got, ok := dst.cacheStore.Get("http://example.com/a")
+	if !ok {
+		t.Fatalf("entry missing after restore")
+	}
+	if string(got.Body) != "warm" || !got.StoredAt.Equal(storedAt) {
+		t.Errorf("restored entry = %+v", got)
+	}
+}
+
+func TestAdminPathsDisabledByDefault(t *testing.T) {
+	cs := New(&Config{})
+	if _, ok := cs.pathHandlers["/admin/snapshot"]; ok {
+		t.Errorf("admin endpoints registered without EnableAdmin")
+	}
+}
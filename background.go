@@ -0,0 +1,96 @@
+package kyache
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultBackgroundFillTimeout is used when Config.BackgroundFillTimeout is
+// zero.
+const DefaultBackgroundFillTimeout = 30 * time.Second
+
+// fillContext runs an origin fetch under a context detached from the
+// client's. When the client goes away the fetch takes a background slot and
+// keeps going for at most the background timeout; without a free slot, or
+// once the response turns out to be uncacheable, it is cancelled as before.
+type fillContext struct {
+	cs     *CacheServer
+	cancel context.CancelFunc
+	stop   func() bool
+
+	mu          sync.Mutex
+	detached    bool
+	finished    bool
+	uncacheable bool
+	timer       *time.Timer
+}
+
+// newFillContext returns the context for an origin fetch made on behalf of
+// r. With background fills disabled it is simply r's context.
+func (cs *CacheServer) newFillContext(r *http.Request) (context.Context, *fillContext) {
+	if cs.backgroundFills == nil {
+		return r.Context(), nil
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	fc := &fillContext{cs: cs, cancel: cancel}
+	fc.stop = context.AfterFunc(r.Context(), func() { fc.detach() })
+	return ctx, fc
+}
+
+// detach is called once the client is gone. It reports whether the fetch
+// may carry on in the background.
+func (fc *fillContext) detach() bool {
+	if fc == nil {
+		return false
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.detached {
+		return true
+	}
+	if fc.finished || fc.uncacheable {
+		fc.cancel()
+		return false
+	}
+	select {
+	case fc.cs.backgroundFills <- struct{}{}:
+	default:
+		fc.cancel()
+		return false
+	}
+	fc.detached = true
+	fc.timer = time.AfterFunc(fc.cs.backgroundFillTimeout, fc.cancel)
+	return true
+}
+
+// markUncacheable stops the fetch from outliving its client, and cancels it
+// if the client has already left.
+func (fc *fillContext) markUncacheable() {
+	if fc == nil {
+		return
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.uncacheable = true
+	if fc.detached {
+		fc.cancel()
+	}
+}
+
+// release ends the fetch and frees its background slot, if it took one.
+func (fc *fillContext) release() {
+	if fc == nil {
+		return
+	}
+	fc.stop()
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.finished = true
+	fc.cancel()
+	if fc.detached {
+		fc.timer.Stop()
+		<-fc.cs.backgroundFills
+	}
+}
@@ -0,0 +1,82 @@
+package kyache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// abandonFetch starts a request for path through a proxy in front of cs,
+// hangs up once the headers arrive and then lets the origin finish. It
+// returns the cache key of path.
+func abandonFetch(t *testing.T, cs *CacheServer, path string) string {
+	t.Helper()
+	release := make(chan struct{})
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("world"))
+	})
+	proxy := httptest.NewServer(cs.Handler(originURL))
+	t.Cleanup(proxy.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", proxy.URL+path, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	resp.Body.Close()
+
+	// Give the proxy a moment to notice the client has gone.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	return originURL.String() + path
+}
+
+func waitForEntry(cs *CacheServer, key string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, ok := cs.cacheStore.Get(key); ok {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestFillFinishesAfterClientDisconnects(t *testing.T) {
+	cs := New(&Config{MaxBackgroundFills: 1})
+	key := abandonFetch(t, cs, "/abandoned")
+
+	if !waitForEntry(cs, key, time.Second) {
+		t.Fatalf("fill did not finish after the client disconnected")
+	}
+	cached, _ := cs.cacheStore.Get(key)
+	if string(cached.Body) != "helloworld" {
+		t.Errorf("cached body = %q, want %q", cached.Body, "helloworld")
+	}
+	// The slot is released just after the entry is stored.
+	deadline := time.Now().Add(time.Second)
+	for len(cs.backgroundFills) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := len(cs.backgroundFills); n != 0 {
+		t.Errorf("%d background slots still held", n)
+	}
+}
+
+func TestFillIsAbandonedWithoutBackgroundFills(t *testing.T) {
+	cs := New(&Config{})
+	key := abandonFetch(t, cs, "/abandoned")
+
+	if waitForEntry(cs, key, 200*time.Millisecond) {
+		t.Errorf("fill finished although background fills are disabled")
+	}
+}
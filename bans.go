@@ -0,0 +1,157 @@
+package kyache
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+// A ban hides every entry stored before it that matches its expression. It
+// is applied lazily: lookups check an entry against the bans added since
+// it was stored and drop it if one matches. A background sweep applies new
+// bans to the whole store, and once it has checked every entry older than
+// a ban, no entry the ban could match remains and the ban is retired.
+//
+// Entries can still arrive older than a ban after the sweep: fills that
+// began before it and restored snapshots. Every entry is checked against
+// the active and the retired bans newer than it before it is stored.
+
+// maxRetiredBans bounds the retired bans kept for checking late entries.
+// Entries older than a ban that has been forgotten are not stored at all.
+const maxRetiredBans = 1000
+
+type activeBan struct {
+	ban     *cache.Ban
+	addedAt time.Time
+}
+
+type banList struct {
+	mu      sync.RWMutex
+	bans    []*activeBan
+	retired []*activeBan // ordered by addedAt
+	// forgotten is when the newest ban dropped from retired was added.
+	forgotten time.Time
+}
+
+func (bl *banList) add(ban *cache.Ban) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.bans = append(bl.bans, &activeBan{ban: ban, addedAt: time.Now()})
+}
+
+func (bl *banList) active() []*activeBan {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	return append([]*activeBan(nil), bl.bans...)
+}
+
+// banned reports whether a ban added after resp was stored matches it.
+func (bl *banList) banned(key string, resp *cache.CachedResponse) bool {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	return matchesBan(bl.bans, key, resp)
+}
+
+func matchesBan(bans []*activeBan, key string, resp *cache.CachedResponse) bool {
+	for _, b := range bans {
+		if b.addedAt.After(resp.StoredAt) && b.ban.Matches(key, resp) {
+			return true
+		}
+	}
+	return false
+}
+
+// refuses reports whether resp must not be stored under key because a ban
+// added after it was stored, active or retired, matches it.
+func (bl *banList) refuses(key string, resp *cache.CachedResponse) bool {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	if resp.StoredAt.Before(bl.forgotten) {
+		return true
+	}
+	if matchesBan(bl.bans, key, resp) {
+		return true
+	}
+	for i := len(bl.retired) - 1; i >= 0 && bl.retired[i].addedAt.After(resp.StoredAt); i-- {
+		if bl.retired[i].ban.Matches(key, resp) {
+			return true
+		}
+	}
+	return false
+}
+
+// retire moves bans that have been applied to the whole store out of the
+// way of lookups.
+func (bl *banList) retire(applied []*activeBan) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	done := make(map[*activeBan]bool, len(applied))
+	for _, b := range applied {
+		done[b] = true
+	}
+	kept := bl.bans[:0]
+	for _, b := range bl.bans {
+		if !done[b] {
+			kept = append(kept, b)
+		}
+	}
+	clear(bl.bans[len(kept):])
+	bl.bans = kept
+
+	bl.retired = append(bl.retired, applied...)
+	sort.Slice(bl.retired, func(i, j int) bool {
+		return bl.retired[i].addedAt.Before(bl.retired[j].addedAt)
+	})
+	if excess := len(bl.retired) - maxRetiredBans; excess > 0 {
+		bl.forgotten = bl.retired[excess-1].addedAt
+		bl.retired = append([]*activeBan(nil), bl.retired[excess:]...)
+	}
+}
+
+// Ban adds a ban expression, such as `req.url ~ ^/api/v1/`. See cache.Ban
+// for the syntax.
+func (cs *CacheServer) Ban(expr string) error {
+	ban, err := cache.ParseBan(expr)
+	if err != nil {
+		return err
+	}
+	cs.bans.add(ban)
+	cs.banSweep.trigger()
+	return nil
+}
+
+// Bans returns the expressions of the bans still in effect.
+func (cs *CacheServer) Bans() []string {
+	active := cs.bans.active()
+	exprs := make([]string, len(active))
+	for i, b := range active {
+		exprs[i] = b.ban.String()
+	}
+	return exprs
+}
+
+// sweepBans deletes every entry matched by a ban and then retires the bans
+// it applied. It runs in the background, started by Ban.
+func (cs *CacheServer) sweepBans() {
+	applied := cs.bans.active()
+	if len(applied) == 0 {
+		return
+	}
+	var banned []string
+	cs.cacheStore.Range(func(key string, resp *cache.CachedResponse) bool {
+		if matchesBan(applied, key, resp) {
+			banned = append(banned, key)
+		}
+		return true
+	})
+	for _, key := range banned {
+		// The entry may have been replaced by a newer one since Range saw
+		// it.
+		if resp, ok := cs.cacheStore.Get(key); ok && matchesBan(applied, key, resp) {
+			cs.evict(key, evictBan)
+		}
+	}
+	cs.bans.retire(applied)
+}
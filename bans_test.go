@@ -0,0 +1,163 @@
+package kyache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+func TestBanAppliesAtLookupToOlderEntries(t *testing.T) {
+	cs := New(&Config{})
+	storeTestEntries(cs, "http://example.com/api/v1/a", "http://example.com/home")
+
+	// Add the ban without starting the sweep, so only lookups apply it.
+	time.Sleep(time.Millisecond)
+	ban, err := cache.ParseBan(`req.url ~ ^/api/v1/`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.bans.add(ban)
+	time.Sleep(time.Millisecond)
+
+	if _, fwd := cs.lookup(context.Background(), "http://example.com/api/v1/a", cache.NewParsedHeaders(http.Header{})); fwd != fwdURIMiss {
+		t.Errorf("banned entry lookup fwd = %q, want %q", fwd, fwdURIMiss)
+	}
+	if _, ok := cs.cacheStore.Get("http://example.com/api/v1/a"); ok {
+		t.Errorf("banned entry was not deleted")
+	}
+	if _, fwd := cs.lookup(context.Background(), "http://example.com/home", cache.NewParsedHeaders(http.Header{})); fwd != "" {
+		t.Errorf("unbanned entry lookup fwd = %q", fwd)
+	}
+
+	// Entries stored after the ban are not affected by it.
+	storeTestEntries(cs, "http://example.com/api/v1/a")
+	if _, fwd := cs.lookup(context.Background(), "http://example.com/api/v1/a", cache.NewParsedHeaders(http.Header{})); fwd != "" {
+		t.Errorf("entry stored after the ban lookup fwd = %q", fwd)
+	}
+}
+
+func TestBanSweepDeletesAndRetires(t *testing.T) {
+	originURL, _ := url.Parse("http://example.com")
+	cs := New(&Config{EnableAdmin: true})
+	storeTestEntries(cs, "http://example.com/api/v1/a", "http://example.com/api/v1/b", "http://example.com/home")
+
+	w := httptest.NewRecorder()
+	cs.Handler(originURL).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/ban", strings.NewReader("req.url ~ ^/api/v1/")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("admin ban = %d %q", w.Code, w.Body.String())
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(cs.Bans()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ban was not retired: %q", cs.Bans())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, key := range []string{"http://example.com/api/v1/a", "http://example.com/api/v1/b"} {
+		if _, ok := cs.cacheStore.Get(key); ok {
+			t.Errorf("%s survived the ban sweep", key)
+		}
+	}
+	if _, ok := cs.cacheStore.Get("http://example.com/home"); !ok {
+		t.Errorf("unbanned entry was deleted")
+	}
+
+	w = httptest.NewRecorder()
+	cs.Handler(originURL).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/ban", strings.NewReader("req.url ?? x")))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("bad ban = %d, want 400", w.Code)
+	}
+}
+
+func TestBanRefusesEntriesOlderThanIt(t *testing.T) {
+	cs := New(&Config{})
+	fillStarted := time.Now().Add(-time.Second)
+	if err := cs.Ban(`req.url ~ ^/api/`); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(cs.Bans()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("ban was not retired: %q", cs.Bans())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	old := func() *cache.CachedResponse {
+		return &cache.CachedResponse{StatusCode: http.StatusOK, RequestHeader: http.Header{}, ResponseHeader: http.Header{}, StoredAt: fillStarted}
+	}
+	// A fill that began before the ban, and a restored entry.
+	cs.store(context.Background(), "http://example.com/api/a", reasonFill, old())
+	cs.cacheStore.Set("http://example.com/api/b", old())
+	cs.cacheStore.Set("http://example.com/home", old())
+
+	for _, key := range []string{"http://example.com/api/a", "http://example.com/api/b"} {
+		if _, ok := cs.cacheStore.Get(key); ok {
+			t.Errorf("%s was stored despite the retired ban", key)
+		}
+	}
+	if _, ok := cs.cacheStore.Get("http://example.com/home"); !ok {
+		t.Errorf("entry the ban does not match was refused")
+	}
+}
+
+// replacedStore hands the sweep an old version of every entry, as if each
+// had been replaced right after the sweep listed it.
+type replacedStore struct {
+	cache.Store
+	old *cache.CachedResponse
+}
+
+func (s *replacedStore) Range(fn func(key string, resp *cache.CachedResponse) bool) {
+	s.Store.Range(func(key string, _ *cache.CachedResponse) bool {
+		return fn(key, s.old)
+	})
+}
+
+func TestBanSweepKeepsReplacedEntries(t *testing.T) {
+	store := &replacedStore{
+		Store: cache.NewCacheStore(),
+		old:   &cache.CachedResponse{StatusCode: http.StatusOK, RequestHeader: http.Header{}, ResponseHeader: http.Header{}, StoredAt: time.Now().Add(-time.Second)},
+	}
+	cs := New(&Config{Store: store})
+	ban, err := cache.ParseBan(`req.url ~ ^/api/`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.bans.add(ban)
+	time.Sleep(time.Millisecond)
+	storeTestEntries(cs, "http://example.com/api/a")
+
+	cs.sweepBans()
+	if _, ok := cs.cacheStore.Get("http://example.com/api/a"); !ok {
+		t.Errorf("sweep deleted an entry stored after the ban")
+	}
+}
+
+func TestRetiredBansAreBounded(t *testing.T) {
+	var bl banList
+	ban, err := cache.ParseBan(`req.url ~ ^/api/`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for range maxRetiredBans + 1 {
+		bl.add(ban)
+	}
+	bl.retire(bl.active())
+	if len(bl.retired) != maxRetiredBans {
+		t.Errorf("kept %d retired bans, want %d", len(bl.retired), maxRetiredBans)
+	}
+	// The forgotten ban cannot be checked, so older entries are refused.
+	resp := &cache.CachedResponse{ResponseHeader: http.Header{}, StoredAt: start.Add(-time.Second)}
+	if !bl.refuses("http://example.com/home", resp) {
+		t.Errorf("entry older than a forgotten ban was accepted")
+	}
+}
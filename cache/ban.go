@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrBadBan = errors.New("cache: bad ban expression")
+
+// Ban is a Varnish-style ban expression: one or more conditions joined by
+// "&&", each comparing a property of a stored entry with a value, as in
+//
+//	req.url ~ ^/api/v1/
+//	obj.http.Content-Type == application/json && obj.status == 404
+//
+// Properties are req.url (path and query), req.http.<name> (the request
+// header the entry was stored for), obj.http.<name> (the response header)
+// and obj.status. Operators are == and != for exact comparison and ~ and !~
+// for regular expressions. Values may be double-quoted, and must be if they
+// contain " &&".
+type Ban struct {
+	expr  string
+	conds []banCond
+}
+
+type banCond struct {
+	field  string
+	header string
+	negate bool
+	value  string
+	re     *regexp.Regexp
+}
+
+// ParseBan parses a ban expression.
+func ParseBan(expr string) (*Ban, error) {
+	b := &Ban{expr: expr}
+	rest := strings.TrimSpace(expr)
+	for {
+		cond, n, err := parseBanCond(rest)
+		if err != nil {
+			return nil, err
+		}
+		b.conds = append(b.conds, cond)
+		rest = strings.TrimSpace(rest[n:])
+		if rest == "" {
+			return b, nil
+		}
+		if !strings.HasPrefix(rest, "&&") {
+			return nil, fmt.Errorf("%w: expected && before %q", ErrBadBan, rest)
+		}
+		rest = strings.TrimSpace(rest[len("&&"):])
+	}
+}
+
+// parseBanCond parses the condition at the start of s and returns how much
+// of s it took up.
+func parseBanCond(s string) (banCond, int, error) {
+	i := strings.IndexAny(s, " \t=!~")
+	if i <= 0 {
+		return banCond{}, 0, fmt.Errorf("%w: %q has no operator", ErrBadBan, s)
+	}
+	field := s[:i]
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	var op string
+	for _, candidate := range []string{"==", "!=", "!~", "~"} {
+		if strings.HasPrefix(s[i:], candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return banCond{}, 0, fmt.Errorf("%w: %q has no operator", ErrBadBan, s)
+	}
+	i += len(op)
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+		i++
+	}
+	value, n, err := parseBanValue(s[i:])
+	if err != nil {
+		return banCond{}, 0, err
+	}
+	n += i
+
+	var cond banCond
+	switch {
+	case field == "req.url" || field == "obj.status":
+		cond.field = field
+	case strings.HasPrefix(field, "req.http.") && len(field) > len("req.http."):
+		cond.field, cond.header = "req.http", field[len("req.http."):]
+	case strings.HasPrefix(field, "obj.http.") && len(field) > len("obj.http."):
+		cond.field, cond.header = "obj.http", field[len("obj.http."):]
+	default:
+		return banCond{}, 0, fmt.Errorf("%w: unknown field %q", ErrBadBan, field)
+	}
+
+	cond.value = value
+	switch op {
+	case "!=":
+		cond.negate = true
+	case "~", "!~":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return banCond{}, 0, fmt.Errorf("%w: %v", ErrBadBan, err)
+		}
+		cond.re = re
+		cond.negate = op == "!~"
+	}
+	return cond, n, nil
+}
+
+// parseBanValue parses the value at the start of s. A double-quoted value
+// ends at the closing quote, so it may contain "&&"; within it a backslash
+// escapes a quote or another backslash and is kept before anything else,
+// as regular expressions need. An unquoted value ends before a "&&" that
+// follows whitespace.
+func parseBanValue(s string) (string, int, error) {
+	if !strings.HasPrefix(s, `"`) {
+		end := len(s)
+		for i := 1; i < len(s); i++ {
+			if (s[i-1] == ' ' || s[i-1] == '\t') && strings.HasPrefix(s[i:], "&&") {
+				end = i
+				break
+			}
+		}
+		return strings.TrimSpace(s[:end]), end, nil
+	}
+	var value strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '"':
+			return value.String(), i + 1, nil
+		case s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\'):
+			i++
+		}
+		value.WriteByte(s[i])
+	}
+	return "", 0, fmt.Errorf("%w: unterminated quote in %q", ErrBadBan, s)
+}
+
+// String returns the expression the ban was parsed from.
+func (b *Ban) String() string {
+	return b.expr
+}
+
+// Matches reports whether the entry stored under key matches every
+// condition of the ban.
+func (b *Ban) Matches(key string, resp *CachedResponse) bool {
+	for _, cond := range b.conds {
+		if !cond.matches(key, resp) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c banCond) matches(key string, resp *CachedResponse) bool {
+	var actual string
+	switch c.field {
+	case "req.url":
+		urlStr, _ := KeyGeneration(key)
+		u, err := url.Parse(urlStr)
+		if err != nil {
+			return false
+		}
+		actual = u.RequestURI()
+	case "req.http":
+		actual = resp.RequestHeader.Get(c.header)
+		if actual == "" && strings.EqualFold(c.header, "Host") {
+			// Go keeps the host out of the request header.
+			urlStr, _ := KeyGeneration(key)
+			if u, err := url.Parse(urlStr); err == nil {
+				actual = u.Host
+			}
+		}
+	case "obj.http":
+		actual = resp.ResponseHeader.Get(c.header)
+	case "obj.status":
+		actual = strconv.Itoa(resp.StatusCode)
+	}
+
+	var matched bool
+	if c.re != nil {
+		matched = c.re.MatchString(actual)
+	} else {
+		matched = actual == c.value
+	}
+	return matched != c.negate
+}
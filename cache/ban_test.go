@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestBanMatches(t *testing.T) {
+	resp := &CachedResponse{
+		StatusCode:     http.StatusNotFound,
+		RequestHeader:  http.Header{"Accept-Language": []string{"en"}},
+		ResponseHeader: http.Header{"Content-Type": []string{"application/json"}},
+	}
+	key := GenerateCacheKeyForGeneration("http://example.com/api/v1/users?page=2", nil, 3)
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`req.url ~ ^/api/v1/`, true},
+		{`req.url ~ ^/api/v2/`, false},
+		{`req.url == /api/v1/users?page=2`, true},
+		{`req.url !~ \.json$`, true},
+		{`obj.http.Content-Type == application/json && obj.status == 404`, true},
+		{`obj.http.Content-Type == application/json && obj.status == 200`, false},
+		{`obj.status!=200`, true},
+		{`obj.http.content-type == "application/json"`, true},
+		{`req.http.Accept-Language == en`, true},
+		{`req.http.Host == example.com`, true},
+		{`req.url ~ "^/api/v1/users\\?page=2&&x|users" && obj.status == 404`, true},
+		{`req.url ~ users&&|^/api/`, true},
+		{`obj.http.Content-Type == "application/\"json\""`, false},
+	}
+	for _, tt := range tests {
+		ban, err := ParseBan(tt.expr)
+		if err != nil {
+			t.Errorf("ParseBan(%q) error = %v", tt.expr, err)
+			continue
+		}
+		if got := ban.Matches(key, resp); got != tt.want {
+			t.Errorf("%q matches = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestParseBanRejectsBadExpressions(t *testing.T) {
+	for _, expr := range []string{
+		``,
+		`req.url`,
+		`req.body == x`,
+		`obj.status > 400`,
+		`req.url ~ (`,
+		`req.url ~ ^/a/ && `,
+		`req.url ~ "^/a/`,
+		`req.url ~ "^/a/" obj.status == 200`,
+	} {
+		if _, err := ParseBan(expr); !errors.Is(err, ErrBadBan) {
+			t.Errorf("ParseBan(%q) error = %v, want %v", expr, err, ErrBadBan)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var ErrIncompleteBody = errors.New("cache: body fill did not complete")
+
+// ChunkedBody is a growable response body. It is appended to while an
+// origin response is being fetched, and any number of readers can follow
+// it: they get the chunks already received at once and then block until
+// more arrive or the body is closed.
+type ChunkedBody struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	chunks [][]byte
+	size   int64
+	closed bool
+	err    error
+}
+
+func NewChunkedBody() *ChunkedBody {
+	b := &ChunkedBody{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Write appends a copy of p as a new chunk.
+func (b *ChunkedBody) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	chunk := make([]byte, len(p))
+	copy(chunk, p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	b.chunks = append(b.chunks, chunk)
+	b.size += int64(len(chunk))
+	b.cond.Broadcast()
+	return len(p), nil
+}
+
+// Close marks the body complete. Readers see io.EOF after the last chunk.
+func (b *ChunkedBody) Close() error {
+	return b.CloseWithError(nil)
+}
+
+// CloseWithError marks the body as finished. Readers see err after the
+// chunks received so far, or io.EOF if err is nil.
+func (b *ChunkedBody) CloseWithError(err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.err = err
+	b.cond.Broadcast()
+	return nil
+}
+
+// Abort marks the body as abandoned, defaulting err to ErrIncompleteBody.
+func (b *ChunkedBody) Abort(err error) {
+	if err == nil {
+		err = ErrIncompleteBody
+	}
+	b.CloseWithError(err)
+}
+
+// Discard aborts the body like Abort and drops the chunks received so far.
+// Readers see err at once rather than after those chunks.
+func (b *ChunkedBody) Discard(err error) {
+	if err == nil {
+		err = ErrIncompleteBody
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.chunks = nil
+	b.size = 0
+	if !b.closed {
+		b.closed = true
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
+
+// Len returns the number of bytes received so far.
+func (b *ChunkedBody) Len() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// Bytes joins the chunks received so far into one slice.
+func (b *ChunkedBody) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]byte, 0, b.size)
+	for _, chunk := range b.chunks {
+		out = append(out, chunk...)
+	}
+	return out
+}
+
+// NewReader returns a reader that starts at the first byte and follows the
+// body as it grows.
+func (b *ChunkedBody) NewReader() io.Reader {
+	return &chunkedReader{body: b}
+}
+
+type chunkedReader struct {
+	body   *ChunkedBody
+	chunk  int
+	offset int
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	b := r.body
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for r.chunk >= len(b.chunks) && !b.closed {
+		b.cond.Wait()
+	}
+	if r.chunk >= len(b.chunks) {
+		if b.err != nil {
+			return 0, b.err
+		}
+		return 0, io.EOF
+	}
+	// Chunks are never modified once appended, so copying out under the
+	// lock only guards the slice header.
+	n := copy(p, b.chunks[r.chunk][r.offset:])
+	r.offset += n
+	if r.offset == len(b.chunks[r.chunk]) {
+		r.chunk++
+		r.offset = 0
+	}
+	return n, nil
+}
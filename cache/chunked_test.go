@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestChunkedBodyReadersFollowWrites(t *testing.T) {
+	body := NewChunkedBody()
+	body.Write([]byte("hello "))
+
+	r := body.NewReader()
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(r, buf); err != nil || string(buf) != "hello " {
+		t.Fatalf("first read = %q, %v", buf, err)
+	}
+
+	done := make(chan []byte)
+	go func() {
+		rest, _ := io.ReadAll(r)
+		done <- rest
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("reader returned before the body was closed")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	body.Write([]byte("world"))
+	body.Close()
+	if rest := <-done; string(rest) != "world" {
+		t.Errorf("rest = %q, want %q", rest, "world")
+	}
+
+	late, _ := io.ReadAll(body.NewReader())
+	if string(late) != "hello world" {
+		t.Errorf("late reader got %q, want %q", late, "hello world")
+	}
+}
+
+func TestChunkedBodyAbortReachesReaders(t *testing.T) {
+	body := NewChunkedBody()
+	body.Write([]byte("partial"))
+	body.Abort(nil)
+
+	got, err := io.ReadAll(body.NewReader())
+	if string(got) != "partial" || !errors.Is(err, ErrIncompleteBody) {
+		t.Errorf("ReadAll() = %q, %v, want %q, %v", got, err, "partial", ErrIncompleteBody)
+	}
+}
+
+func TestChunkedBodyDiscardDropsChunks(t *testing.T) {
+	body := NewChunkedBody()
+	body.Write([]byte("partial"))
+	r := body.NewReader()
+	io.ReadFull(r, make([]byte, 3))
+	body.Discard(nil)
+
+	if n := body.Len(); n != 0 {
+		t.Errorf("Len() = %d after Discard, want 0", n)
+	}
+	if got, err := io.ReadAll(r); len(got) != 0 || !errors.Is(err, ErrIncompleteBody) {
+		t.Errorf("ReadAll() = %q, %v, want nothing and %v", got, err, ErrIncompleteBody)
+	}
+}
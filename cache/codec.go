@@ -0,0 +1,308 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Serialized entry layout (all integers are varints unless noted):
+//
+//	magic "KYCE" | version byte | key | status | proto major | proto minor | proto |
+//	stored at (unix nano) | initial age | invalidated at (unix nano, 0 if unset) |
+//	request header | response header | body |
+//	crc32 of everything before it (4 bytes, big endian)
+//
+// Version 1 entries have no invalidated at field and are still read.
+//
+// Strings and the body are length-prefixed. Headers are a count followed by
+// (name, value count, values...) tuples sorted by name.
+const (
+	entryMagic   = "KYCE"
+	entryVersion = 2
+)
+
+var (
+	ErrBadMagic           = errors.New("cache: bad entry magic")
+	ErrUnsupportedVersion = errors.New("cache: unsupported entry version")
+	ErrChecksumMismatch   = errors.New("cache: entry checksum mismatch")
+)
+
+type entryWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (ew *entryWriter) write(p []byte) {
+	if ew.err != nil {
+		return
+	}
+	ew.crc.Write(p)
+	_, ew.err = ew.w.Write(p)
+}
+
+func (ew *entryWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(ew.buf[:], v)
+	ew.write(ew.buf[:n])
+}
+
+func (ew *entryWriter) varint(v int64) {
+	n := binary.PutVarint(ew.buf[:], v)
+	ew.write(ew.buf[:n])
+}
+
+func (ew *entryWriter) bytes(p []byte) {
+	ew.uvarint(uint64(len(p)))
+	ew.write(p)
+}
+
+func (ew *entryWriter) string(s string) {
+	ew.bytes([]byte(s))
+}
+
+func (ew *entryWriter) header(h http.Header) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ew.uvarint(uint64(len(names)))
+	for _, name := range names {
+		ew.string(name)
+		ew.uvarint(uint64(len(h[name])))
+		for _, v := range h[name] {
+			ew.string(v)
+		}
+	}
+}
+
+// EncodeEntry writes key and resp to w in the versioned entry format.
+func EncodeEntry(w io.Writer, key string, resp *CachedResponse) error {
+	return encodeEntry(w, key, resp, entryVersion)
+}
+
+func encodeEntry(w io.Writer, key string, resp *CachedResponse, version byte) error {
+	ew := &entryWriter{w: bufio.NewWriter(w), crc: crc32.NewIEEE()}
+	ew.write([]byte(entryMagic))
+	ew.write([]byte{version})
+	ew.string(key)
+	ew.uvarint(uint64(resp.StatusCode))
+	ew.uvarint(uint64(resp.ProtoMajor))
+	ew.uvarint(uint64(resp.ProtoMinor))
+	ew.string(resp.Proto)
+	ew.varint(resp.StoredAt.UnixNano())
+	ew.varint(int64(resp.InitialAge))
+	if version >= 2 {
+		var invalidatedAt int64
+		if !resp.InvalidatedAt.IsZero() {
+			invalidatedAt = resp.InvalidatedAt.UnixNano()
+		}
+		ew.varint(invalidatedAt)
+	}
+	ew.header(resp.RequestHeader)
+	ew.header(resp.ResponseHeader)
+	ew.bytes(resp.Body)
+	if ew.err != nil {
+		return ew.err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], ew.crc.Sum32())
+	if _, err := ew.w.Write(sum[:]); err != nil {
+		return err
+	}
+	return ew.w.Flush()
+}
+
+type entryReader struct {
+	src     io.Reader
+	crc     hash.Hash32
+	version byte
+}
+
+func newEntryReader(r io.Reader) *entryReader {
+	crc := crc32.NewIEEE()
+	return &entryReader{src: io.TeeReader(r, crc), crc: crc}
+}
+
+// ReadByte lets binary.ReadUvarint consume the tee directly. Callers are
+// expected to hand DecodeEntry a buffered reader.
+func (er *entryReader) ReadByte() (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(er.src, b[:]); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (er *entryReader) uvarint() (uint64, error) {
+	return binary.ReadUvarint(er)
+}
+
+func (er *entryReader) varint() (int64, error) {
+	return binary.ReadVarint(er)
+}
+
+func (er *entryReader) bytes() ([]byte, error) {
+	n, err := er.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	// Copy through a growing buffer rather than allocating n up front so a
+	// corrupted length cannot force a huge allocation.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, er.src, int64(n)); err != nil {
+		return nil, unexpected(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (er *entryReader) string() (string, error) {
+	b, err := er.bytes()
+	return string(b), err
+}
+
+func (er *entryReader) header() (http.Header, error) {
+	count, err := er.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	h := make(http.Header)
+	for i := uint64(0); i < count; i++ {
+		name, err := er.string()
+		if err != nil {
+			return nil, err
+		}
+		n, err := er.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < n; j++ {
+			v, err := er.string()
+			if err != nil {
+				return nil, err
+			}
+			h[name] = append(h[name], v)
+		}
+	}
+	return h, nil
+}
+
+func (er *entryReader) preamble() (string, error) {
+	magic := make([]byte, len(entryMagic))
+	if _, err := io.ReadFull(er.src, magic); err != nil {
+		return "", err
+	}
+	if string(magic) != entryMagic {
+		return "", ErrBadMagic
+	}
+	version, err := er.ReadByte()
+	if err != nil {
+		return "", unexpected(err)
+	}
+	if version < 1 || version > entryVersion {
+		return "", fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+	er.version = version
+	return er.string()
+}
+
+// DecodeEntry reads one entry written by EncodeEntry and verifies its checksum.
+// It returns io.EOF only when r is exhausted before the first byte.
+func DecodeEntry(r io.Reader) (string, *CachedResponse, error) {
+	er := newEntryReader(r)
+	key, err := er.preamble()
+	if err != nil {
+		return "", nil, err
+	}
+	resp, err := er.response()
+	if err != nil {
+		return "", nil, unexpected(err)
+	}
+	want := er.crc.Sum32()
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return "", nil, unexpected(err)
+	}
+	if binary.BigEndian.Uint32(sum[:]) != want {
+		return "", nil, ErrChecksumMismatch
+	}
+	return key, resp, nil
+}
+
+// DecodeEntryKey reads only the key of an encoded entry. The checksum is not
+// verified.
+func DecodeEntryKey(r io.Reader) (string, error) {
+	key, err := newEntryReader(r).preamble()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return key, err
+}
+
+func (er *entryReader) response() (*CachedResponse, error) {
+	resp := &CachedResponse{}
+	status, err := er.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	major, err := er.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	minor, err := er.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Proto, err = er.string(); err != nil {
+		return nil, err
+	}
+	storedAt, err := er.varint()
+	if err != nil {
+		return nil, err
+	}
+	initialAge, err := er.varint()
+	if err != nil {
+		return nil, err
+	}
+	if er.version >= 2 {
+		invalidatedAt, err := er.varint()
+		if err != nil {
+			return nil, err
+		}
+		if invalidatedAt != 0 {
+			resp.InvalidatedAt = time.Unix(0, invalidatedAt)
+		}
+	}
+	if resp.RequestHeader, err = er.header(); err != nil {
+		return nil, err
+	}
+	if resp.ResponseHeader, err = er.header(); err != nil {
+		return nil, err
+	}
+	if resp.Body, err = er.bytes(); err != nil {
+		return nil, err
+	}
+	resp.StatusCode = int(status)
+	resp.ProtoMajor = int(major)
+	resp.ProtoMinor = int(minor)
+	resp.StoredAt = time.Unix(0, storedAt)
+	resp.InitialAge = int(initialAge)
+	return resp, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,407 @@
+package cache
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	diskEntryExt  = ".kyc"
+	diskTempGlob  = ".tmp-*"
+	diskTempStart = ".tmp-"
+)
+
+// DiskStore keeps one file per entry under dir. Files are written to a
+// temporary name and renamed into place, so a crash leaves either the old
+// entry or the new one. The index is rebuilt from the directory on startup.
+type DiskStore struct {
+	dir      string
+	maxBytes int64
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	index   map[string]*diskEntry
+	lru     *list.List // front is most recently used
+	size    int64
+	onEvict func(key string)
+}
+
+type diskEntry struct {
+	key  string
+	path string
+	size int64
+	elem *list.Element
+}
+
+// DiskConfig configures a DiskStore.
+type DiskConfig struct {
+	// MaxBytes bounds the total size of entry files. Zero or less means
+	// unbounded.
+	MaxBytes int64
+	// Logger receives unreadable and unwritable entries, usually the same
+	// logger as kyache's Config.Logger. Defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// NewDiskStore opens (or creates) a disk store in dir. maxBytes bounds the
+// total size of entry files; zero or less means unbounded.
+func NewDiskStore(dir string, maxBytes int64) (*DiskStore, error) {
+	return NewDiskStoreWithConfig(dir, DiskConfig{MaxBytes: maxBytes})
+}
+
+// NewDiskStoreWithConfig is NewDiskStore with further settings.
+func NewDiskStoreWithConfig(dir string, config DiskConfig) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	ds := &DiskStore{
+		dir:      dir,
+		maxBytes: config.MaxBytes,
+		logger:   config.Logger,
+		index:    make(map[string]*diskEntry),
+		lru:      list.New(),
+	}
+	if ds.logger == nil {
+		ds.logger = slog.Default()
+	}
+	if err := ds.rebuild(); err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+func (ds *DiskStore) rebuild() error {
+	type found struct {
+		entry   *diskEntry
+		modTime time.Time
+	}
+	var entries []found
+
+	err := filepath.WalkDir(ds.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		// Leftovers of writes that never got renamed into place.
+		if strings.HasPrefix(d.Name(), diskTempStart) {
+			os.Remove(path)
+			return nil
+		}
+		if filepath.Ext(path) != diskEntryExt {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		key, err := readDiskEntryKey(path)
+		if err != nil || ds.pathFor(key) != path {
+			ds.logger.Warn("removing unreadable cache file", slog.String("path", path), slog.Any("error", err))
+			os.Remove(path)
+			return nil
+		}
+		entries = append(entries, found{
+			entry:   &diskEntry{key: key, path: path, size: info.Size()},
+			modTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Oldest files go to the back of the LRU list.
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].modTime.After(entries[j].modTime)
+	})
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for _, f := range entries {
+		f.entry.elem = ds.lru.PushBack(f.entry)
+		ds.index[f.entry.key] = f.entry
+		ds.size += f.entry.size
+	}
+	ds.evictLocked()
+	return nil
+}
+
+func readDiskEntryKey(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return DecodeEntryKey(bufio.NewReader(f))
+}
+
+func (ds *DiskStore) pathFor(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(ds.dir, name[:2], name+diskEntryExt)
+}
+
+func (ds *DiskStore) Get(key string) (*CachedResponse, bool) {
+	ds.mu.Lock()
+	entry, ok := ds.index[key]
+	if ok {
+		ds.lru.MoveToFront(entry.elem)
+	}
+	ds.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	resp, err := ds.read(entry)
+	if err != nil {
+		// A missing file was deleted or evicted since the index was read.
+		if !os.IsNotExist(err) {
+			ds.logger.Warn("dropping corrupt cache entry", slog.String("key", key), slog.String("error", err.Error()))
+		}
+		ds.remove(entry)
+		return nil, false
+	}
+	return resp, true
+}
+
+// Peek reads key like Get without moving it up the LRU list or dropping it
+// if it is corrupt.
+func (ds *DiskStore) Peek(key string) (*CachedResponse, bool) {
+	ds.mu.Lock()
+	entry, ok := ds.index[key]
+	ds.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	resp, err := ds.read(entry)
+	return resp, err == nil
+}
+
+func (ds *DiskStore) read(entry *diskEntry) (*CachedResponse, error) {
+	f, err := os.Open(entry.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	key, resp, err := DecodeEntry(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	if key != entry.key {
+		return nil, ErrChecksumMismatch
+	}
+	return resp, nil
+}
+
+// Range reads every entry from disk. Entries that fail to decode are
+// dropped and skipped.
+func (ds *DiskStore) Range(fn func(key string, resp *CachedResponse) bool) {
+	ds.mu.Lock()
+	entries := make([]*diskEntry, 0, len(ds.index))
+	for _, entry := range ds.index {
+		entries = append(entries, entry)
+	}
+	ds.mu.Unlock()
+
+	for _, entry := range entries {
+		resp, err := ds.read(entry)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				ds.logger.Warn("dropping corrupt cache entry", slog.String("key", entry.key), slog.String("error", err.Error()))
+			}
+			ds.remove(entry)
+			continue
+		}
+		if !fn(entry.key, resp) {
+			return
+		}
+	}
+}
+
+// contains reports whether key is stored, without reading it.
+func (ds *DiskStore) contains(key string) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	_, ok := ds.index[key]
+	return ok
+}
+
+// RangeKeys lists the keys from the index without touching the files.
+func (ds *DiskStore) RangeKeys(fn func(key string) bool) {
+	ds.mu.Lock()
+	keys := make([]string, 0, len(ds.index))
+	for key := range ds.index {
+		keys = append(keys, key)
+	}
+	ds.mu.Unlock()
+
+	for _, key := range keys {
+		if !fn(key) {
+			return
+		}
+	}
+}
+
+// RangeSizes implements SizeRanger with the file sizes from the index.
+func (ds *DiskStore) RangeSizes(fn func(key string, size int64) bool) {
+	ds.mu.Lock()
+	sizes := make(map[string]int64, len(ds.index))
+	for key, entry := range ds.index {
+		sizes[key] = entry.size
+	}
+	ds.mu.Unlock()
+
+	for key, size := range sizes {
+		if !fn(key, size) {
+			return
+		}
+	}
+}
+
+func (ds *DiskStore) Set(key string, resp *CachedResponse) {
+	path := ds.pathFor(key)
+	tmp, size, err := ds.writeTemp(path, key, resp)
+	if err != nil {
+		ds.logger.Error("failed to write cache entry", slog.String("key", key), slog.String("error", err.Error()))
+		return
+	}
+	defer os.Remove(tmp) // no-op once renamed
+
+	ds.mu.Lock()
+	// Renaming under the lock keeps the index and the files in step with
+	// concurrent evictions of the same key.
+	if err := os.Rename(tmp, path); err != nil {
+		ds.mu.Unlock()
+		ds.logger.Error("failed to write cache entry", slog.String("key", key), slog.String("error", err.Error()))
+		return
+	}
+	if old, ok := ds.index[key]; ok {
+		ds.lru.Remove(old.elem)
+		ds.size -= old.size
+	}
+	entry := &diskEntry{key: key, path: path, size: size}
+	entry.elem = ds.lru.PushFront(entry)
+	ds.index[key] = entry
+	ds.size += size
+	evicted, onEvict := ds.evictLocked(), ds.onEvict
+	ds.mu.Unlock()
+
+	if onEvict != nil {
+		for _, key := range evicted {
+			onEvict(key)
+		}
+	}
+}
+
+// NotifyEvict implements EvictionNotifier.
+func (ds *DiskStore) NotifyEvict(fn func(key string)) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.onEvict = fn
+}
+
+// writeTemp encodes the entry into a synced temporary file next to path.
+func (ds *DiskStore) writeTemp(path, key string, resp *CachedResponse) (string, int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), diskTempGlob)
+	if err != nil {
+		return "", 0, err
+	}
+	size, err := writeEntryFile(tmp, key, resp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	return tmp.Name(), size, nil
+}
+
+func writeEntryFile(f *os.File, key string, resp *CachedResponse) (int64, error) {
+	if err := EncodeEntry(f, key, resp); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Delete removes key from the store and reports whether it was present.
+func (ds *DiskStore) Delete(key string) bool {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	entry, ok := ds.index[key]
+	if ok {
+		ds.removeLocked(entry)
+	}
+	return ok
+}
+
+func (ds *DiskStore) remove(entry *diskEntry) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	// The entry may have been replaced by a concurrent Set.
+	if ds.index[entry.key] != entry {
+		return
+	}
+	ds.removeLocked(entry)
+}
+
+func (ds *DiskStore) removeLocked(entry *diskEntry) {
+	ds.lru.Remove(entry.elem)
+	delete(ds.index, entry.key)
+	ds.size -= entry.size
+	os.Remove(entry.path)
+}
+
+// evictLocked drops least recently used entries until the store fits its
+// budget, and returns their keys.
+func (ds *DiskStore) evictLocked() []string {
+	if ds.maxBytes <= 0 {
+		return nil
+	}
+	var evicted []string
+	for ds.size > ds.maxBytes {
+		back := ds.lru.Back()
+		if back == nil {
+			break
+		}
+		entry := back.Value.(*diskEntry)
+		ds.removeLocked(entry)
+		evicted = append(evicted, entry.key)
+	}
+	return evicted
+}
+
+// Size returns the total size in bytes of the entry files.
+func (ds *DiskStore) Size() int64 {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.size
+}
+
+// Len returns the number of entries in the store.
+func (ds *DiskStore) Len() int {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return len(ds.index)
+}
@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestResponse(body string) *CachedResponse {
+	return &CachedResponse{
+		StatusCode:     http.StatusOK,
+		RequestHeader:  http.Header{"Accept": []string{"text/html"}},
+		ResponseHeader: http.Header{"Cache-Control": []string{"max-age=60"}, "Vary": []string{"Accept", "Accept-Language"}},
+		Body:           []byte(body),
+		StoredAt:       time.Unix(1700000000, 123456789),
+		InitialAge:     7,
+		ProtoMajor:     2,
+		ProtoMinor:     0,
+		Proto:          "HTTP/2.0",
+	}
+}
+
+func TestEncodeDecodeEntry(t *testing.T) {
+	want := newTestResponse("hello")
+	var buf bytes.Buffer
+	if err := EncodeEntry(&buf, "http://example.com/", want); err != nil {
+		t.Fatalf("EncodeEntry() error = %v", err)
+	}
+
+	key, got, err := DecodeEntry(&buf)
+	if err != nil {
+		t.Fatalf("DecodeEntry() error = %v", err)
+	}
+	if key != "http://example.com/" {
+		t.Errorf("key = %q, want %q", key, "http://example.com/")
+	}
+	if !got.StoredAt.Equal(want.StoredAt) {
+		t.Errorf("StoredAt = %v, want %v", got.StoredAt, want.StoredAt)
+	}
+	got.StoredAt = want.StoredAt
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded entry = %+v, want %+v", got, want)
+	}
+}
+
+func TestDecodeEntryInvalidatedAt(t *testing.T) {
+	want := newTestResponse("hello")
+	want.InvalidatedAt = time.Unix(1700000100, 0)
+	var buf bytes.Buffer
+	if err := EncodeEntry(&buf, "k", want); err != nil {
+		t.Fatalf("EncodeEntry() error = %v", err)
+	}
+	_, got, err := DecodeEntry(&buf)
+	if err != nil {
+		t.Fatalf("DecodeEntry() error = %v", err)
+	}
+	if !got.InvalidatedAt.Equal(want.InvalidatedAt) {
+		t.Errorf("InvalidatedAt = %v, want %v", got.InvalidatedAt, want.InvalidatedAt)
+	}
+}
+
+func TestDecodeEntryReadsVersion1(t *testing.T) {
+	want := newTestResponse("hello")
+	var buf bytes.Buffer
+	if err := encodeEntry(&buf, "k", want, 1); err != nil {
+		t.Fatalf("encodeEntry() error = %v", err)
+	}
+	_, got, err := DecodeEntry(&buf)
+	if err != nil {
+		t.Fatalf("DecodeEntry() error = %v", err)
+	}
+	if string(got.Body) != "hello" || !got.InvalidatedAt.IsZero() {
+		t.Errorf("decoded entry = %+v", got)
+	}
+}
+
+func TestDecodeEntryDetectsCorruption(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeEntry(&buf, "k", newTestResponse("hello")); err != nil {
+		t.Fatalf("EncodeEntry() error = %v", err)
+	}
+	data := buf.Bytes()
+	data[len(data)-6] ^= 0xff // inside the body
+
+	if _, _, err := DecodeEntry(bytes.NewReader(data)); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("DecodeEntry() error = %v, want %v", err, ErrChecksumMismatch)
+	}
+}
+
+func TestDiskStorePersistsAcrossReopen(t *testing.T) {
+	dir := t.TempDir()
+	ds, err := NewDiskStore(dir, 0)
+	if err != nil {
+		t.Fatalf("NewDiskStore() error = %v", err)
+	}
+	ds.Set("a", newTestResponse("first"))
+	ds.Set("b", newTestResponse("second"))
+
+	reopened, err := NewDiskStore(dir, 0)
+	if err != nil {
+		t.Fatalf("NewDiskStore() error = %v", err)
+	}
+	if reopened.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", reopened.Len())
+	}
+	got, ok := reopened.Get("b")
+	if !ok {
+		t.Fatalf("Get(b) missing after reopen")
+	}
+	if string(got.Body) != "second" || got.InitialAge != 7 {
+		t.Errorf("Get(b) = %+v", got)
+	}
+}
+
+func TestDiskStoreDropsCorruptEntries(t *testing.T) {
+	var logs bytes.Buffer
+	ds, err := NewDiskStoreWithConfig(t.TempDir(), DiskConfig{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	if err != nil {
+		t.Fatalf("NewDiskStoreWithConfig() error = %v", err)
+	}
+	ds.Set("a", newTestResponse("payload"))
+
+	path := ds.pathFor("a")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-6] ^= 0xff
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ds.Get("a"); ok {
+		t.Fatalf("Get() returned a corrupt entry")
+	}
+	if ds.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", ds.Len())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("corrupt file still present: %v", err)
+	}
+	if !strings.Contains(logs.String(), `msg="dropping corrupt cache entry" key=a`) {
+		t.Errorf("logs = %q, want the dropped entry", logs.String())
+	}
+}
+
+func TestDiskStoreDoesNotLogMissingFiles(t *testing.T) {
+	var logs bytes.Buffer
+	ds, err := NewDiskStoreWithConfig(t.TempDir(), DiskConfig{Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	if err != nil {
+		t.Fatalf("NewDiskStoreWithConfig() error = %v", err)
+	}
+	ds.Set("a", newTestResponse("payload"))
+	// As if a concurrent Delete removed the file after Get found the key.
+	if err := os.Remove(ds.pathFor("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ds.Get("a"); ok {
+		t.Fatalf("Get() returned a missing entry")
+	}
+	if ds.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", ds.Len())
+	}
+	if logs.Len() != 0 {
+		t.Errorf("logs = %q, want nothing for a missing file", logs.String())
+	}
+}
+
+func TestDiskStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	ds, err := NewDiskStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("NewDiskStore() error = %v", err)
+	}
+	ds.Set("a", newTestResponse("0123456789"))
+	entrySize := ds.Size()
+
+	var evicted []string
+	ds.NotifyEvict(func(key string) { evicted = append(evicted, key) })
+
+	ds.maxBytes = 2 * entrySize
+	ds.Set("b", newTestResponse("0123456789"))
+	ds.Get("a") // a is now more recently used than b
+	ds.Set("c", newTestResponse("0123456789"))
+
+	if _, ok := ds.Get("b"); ok {
+		t.Errorf("b should have been evicted")
+	}
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Errorf("evictions reported = %q, want [b]", evicted)
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := ds.Get(key); !ok {
+			t.Errorf("%s should still be cached", key)
+		}
+	}
+	if ds.Size() > ds.maxBytes {
+		t.Errorf("Size() = %d exceeds budget %d", ds.Size(), ds.maxBytes)
+	}
+}
@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ExplainCacheable is IsCacheable with the reason a response may not be
+// stored, such as "no-store in CDN-Cache-Control". The reason is empty when
+// the response is cacheable.
+func ExplainCacheable(method string, header *ParsedHeaders) (bool, string) {
+	if method != http.MethodGet {
+		return false, "method " + method
+	}
+	for _, name := range []string{"Cache-Control", "CDN-Cache-Control"} {
+		// TODO: Handle "no-cache" directive according to RFC 9111
+		// Need interpretation of the section 5.2.1.4.
+		for _, directive := range []string{"no-cache", "no-store", "private"} {
+			if _, ok := header.GetDirective(name, directive); ok {
+				return false, directive + " in " + name
+			}
+		}
+		if name == "Cache-Control" && header.IsVaryWildcard() {
+			// Vary: * means the response is not cacheable
+			return false, "Vary: *"
+		}
+	}
+	return true, ""
+}
+
+// ExplainReqAllowedToUseCache is IsReqAllowedToUseCache with the reason a
+// stored response may not be used, such as "Vary mismatch on
+// Accept-Language". The reason is empty when it may be used.
+func ExplainReqAllowedToUseCache(reqHeader, originalReqHeader, respHeader *ParsedHeaders) (bool, string) {
+	// When Authorization header is present, the request cannot be responded with cache unless
+	// any of public, must-revalidate, or s-maxage directive is present in the response header.
+	_, reqHasAuthorization := reqHeader.GetDirectives("Authorization")
+	if reqHasAuthorization {
+		_, respHasPublic := respHeader.GetDirective("Cache-Control", "public")
+		_, respHasMustRevalidate := respHeader.GetDirective("Cache-Control", "must-revalidate")
+		_, respHasSMaxAge := respHeader.GetDirective("Cache-Control", "s-maxage")
+		if !respHasPublic && !respHasMustRevalidate && !respHasSMaxAge {
+			return false, "Authorization without public, must-revalidate or s-maxage"
+		}
+	}
+
+	field, ok := varyMismatch(reqHeader, originalReqHeader, respHeader)
+	if !ok {
+		if field == "*" {
+			return false, "Vary: *"
+		}
+		return false, "Vary mismatch on " + http.CanonicalHeaderKey(field)
+	}
+	return true, ""
+}
+
+// Freshness describes how fresh a stored response is and why. Its String
+// method sums it up, such as "heuristic freshness 3h from Last-Modified,
+// stale by 12s".
+type Freshness struct {
+	Fresh bool
+	// Lifetime is the freshness lifetime and Source what set it:
+	// "CDN-Cache-Control max-age", "s-maxage", "max-age", "Expires", or
+	// "Last-Modified" for heuristic freshness. Source is empty when the
+	// response has no freshness lifetime.
+	Lifetime  time.Duration
+	Source    string
+	Heuristic bool
+	Age       time.Duration
+	// Invalidated is set for a soft purged response, which is never fresh.
+	Invalidated bool
+}
+
+// ExplainFreshness is IsFresh with the freshness lifetime and age behind it.
+func ExplainFreshness(resp *CachedResponse) Freshness {
+	headerStruct := NewParsedHeaders(resp.ResponseHeader)
+	f := Freshness{
+		Age:         time.Duration(GetCurrentAge(resp)) * time.Second,
+		Invalidated: !resp.InvalidatedAt.IsZero(),
+	}
+	f.Lifetime, f.Source = explicitFreshness(headerStruct)
+	if f.Lifetime == 0 && !hasExplicitFreshness(headerStruct) {
+		f.Lifetime = getHeuristicFreshnessLifetime(headerStruct, resp.StatusCode)
+		if f.Lifetime > 0 {
+			f.Source, f.Heuristic = "Last-Modified", true
+		}
+	}
+	f.Fresh = !f.Invalidated && f.Lifetime > 0 && f.Age < f.Lifetime
+	return f
+}
+
+func (f Freshness) String() string {
+	var b strings.Builder
+	switch {
+	case f.Heuristic:
+		fmt.Fprintf(&b, "heuristic freshness %s from %s", formatDuration(f.Lifetime), f.Source)
+	case f.Source != "":
+		fmt.Fprintf(&b, "freshness %s from %s", formatDuration(f.Lifetime), f.Source)
+	default:
+		b.WriteString("no freshness lifetime")
+	}
+	switch {
+	case f.Invalidated:
+		b.WriteString(", invalidated by soft purge")
+	case f.Fresh:
+		fmt.Fprintf(&b, ", fresh for %s", formatDuration(f.Lifetime-f.Age))
+	default:
+		fmt.Fprintf(&b, ", stale by %s", formatDuration(f.Age-f.Lifetime))
+	}
+	return b.String()
+}
+
+// formatDuration formats d to the second without zero trailing units, so
+// three hours is "3h" rather than "3h0m0s".
+func formatDuration(d time.Duration) string {
+	s := d.Round(time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
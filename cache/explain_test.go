@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestExplainCacheable(t *testing.T) {
+	tests := []struct {
+		method string
+		header http.Header
+		want   string
+	}{
+		{"GET", http.Header{"Cache-Control": {"max-age=60"}}, ""},
+		{"POST", http.Header{}, "method POST"},
+		{"GET", http.Header{"Cache-Control": {"private"}}, "private in Cache-Control"},
+		{"GET", http.Header{"Vary": {"*"}}, "Vary: *"},
+		{"GET", http.Header{"CDN-Cache-Control": {"no-store"}}, "no-store in CDN-Cache-Control"},
+	}
+	for _, tt := range tests {
+		header := NewParsedHeaders(tt.header)
+		ok, why := ExplainCacheable(tt.method, header)
+		if why != tt.want || ok != (tt.want == "") {
+			t.Errorf("ExplainCacheable(%s, %v) = %v, %q, want %q", tt.method, tt.header, ok, why, tt.want)
+		}
+		if ok != IsCacheable(tt.method, header) {
+			t.Errorf("ExplainCacheable(%s, %v) disagrees with IsCacheable", tt.method, tt.header)
+		}
+	}
+}
+
+func TestExplainReqAllowedToUseCacheNamesVaryMismatch(t *testing.T) {
+	respHeader := NewParsedHeaders(http.Header{"Vary": {"Accept-Encoding, Accept-Language"}})
+	original := NewParsedHeaders(http.Header{"Accept-Encoding": {"gzip"}, "Accept-Language": {"en"}})
+	req := NewParsedHeaders(http.Header{"Accept-Encoding": {"gzip"}, "Accept-Language": {"ja"}})
+
+	ok, why := ExplainReqAllowedToUseCache(req, original, respHeader)
+	if ok || why != "Vary mismatch on Accept-Language" {
+		t.Errorf("ExplainReqAllowedToUseCache = %v, %q", ok, why)
+	}
+}
+
+func TestExplainFreshness(t *testing.T) {
+	heuristic := &CachedResponse{
+		StatusCode: http.StatusOK,
+		ResponseHeader: http.Header{
+			"Date":          {"Wed, 21 Oct 2015 07:28:00 GMT"},
+			"Last-Modified": {"Mon, 19 Oct 2015 01:28:00 GMT"},
+		},
+		StoredAt: time.Now().Add(-time.Hour),
+	}
+	f := ExplainFreshness(heuristic)
+	if !f.Fresh || !f.Heuristic || f.Lifetime != 5*time.Hour+24*time.Minute {
+		t.Errorf("ExplainFreshness = %+v", f)
+	}
+	if got, want := f.String(), "heuristic freshness 5h24m from Last-Modified, fresh for 4h24m"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	stale := &CachedResponse{
+		StatusCode:     http.StatusOK,
+		ResponseHeader: http.Header{"Cache-Control": {"max-age=60"}},
+		StoredAt:       time.Now().Add(-72 * time.Second),
+	}
+	if got, want := ExplainFreshness(stale).String(), "freshness 1m from max-age, stale by 12s"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+
+	stale.InvalidatedAt = time.Now()
+	stale.StoredAt = time.Now()
+	if got, want := ExplainFreshness(stale).String(), "freshness 1m from max-age, invalidated by soft purge"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
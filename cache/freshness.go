@@ -9,10 +9,51 @@ import (
 // see freshness.md for what these functions do
 
 func IsFresh(resp *CachedResponse) bool {
+	return ExplainFreshness(resp).Fresh
+}
+
+// Staleness returns how long resp has been stale, or zero while it is
+// fresh. A soft purged response is stale at least since it was invalidated.
+func Staleness(resp *CachedResponse) time.Duration {
 	headerStruct := NewParsedHeaders(resp.ResponseHeader)
 	freshFor := GetFreshnessLifetimeForStatus(headerStruct, resp.StatusCode)
 	currentAge := time.Duration(GetCurrentAge(resp)) * time.Second
-	return freshFor > 0 && currentAge < freshFor
+	staleness := max(currentAge-freshFor, 0)
+	if !resp.InvalidatedAt.IsZero() {
+		staleness = max(staleness, time.Since(resp.InvalidatedAt))
+	}
+	return staleness
+}
+
+// StaleWhileRevalidate reports whether resp may be served stale while it is
+// revalidated in the background (RFC 5861).
+func StaleWhileRevalidate(resp *CachedResponse) bool {
+	return mayServeStale(resp, "stale-while-revalidate")
+}
+
+// StaleIfError reports whether resp may be served stale because the origin
+// could not be reached or answered with a server error (RFC 5861).
+func StaleIfError(resp *CachedResponse) bool {
+	return mayServeStale(resp, "stale-if-error")
+}
+
+func mayServeStale(resp *CachedResponse, directive string) bool {
+	headerStruct := NewParsedHeaders(resp.ResponseHeader)
+	if _, ok := headerStruct.GetDirective("Cache-Control", "must-revalidate"); ok {
+		return false
+	}
+	if _, ok := headerStruct.GetDirective("Cache-Control", "proxy-revalidate"); ok {
+		return false
+	}
+	value, ok := headerStruct.GetDirective("Cache-Control", directive)
+	if !ok {
+		return false
+	}
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return false
+	}
+	return Staleness(resp) <= time.Duration(seconds)*time.Second
 }
 
 func GetFreshnessLifetime(headerStruct *ParsedHeaders) time.Duration {
@@ -28,12 +69,19 @@ func GetFreshnessLifetimeForStatus(headerStruct *ParsedHeaders, statusCode int)
 }
 
 func getExplicitFreshnessLifetime(headerStruct *ParsedHeaders) time.Duration {
+	freshFor, _ := explicitFreshness(headerStruct)
+	return freshFor
+}
+
+// explicitFreshness returns the explicit freshness lifetime and the
+// directive or header it came from, or an empty source if there is none.
+func explicitFreshness(headerStruct *ParsedHeaders) (time.Duration, string) {
 	// CDN-Cache-Control
 	cdnMaxAge, hasCDNMaxAge := headerStruct.GetDirective("CDN-Cache-Control", "max-age")
 	if hasCDNMaxAge {
 		seconds, err := strconv.Atoi(cdnMaxAge)
 		if err == nil && seconds >= 0 {
-			return time.Duration(seconds) * time.Second
+			return time.Duration(seconds) * time.Second, "CDN-Cache-Control max-age"
 		}
 	}
 	// Cache-Control s-maxage
@@ -41,7 +89,7 @@ func getExplicitFreshnessLifetime(headerStruct *ParsedHeaders) time.Duration {
 	if hasSMaxAge {
 		seconds, err := strconv.Atoi(sMaxAge)
 		if err == nil && seconds >= 0 {
-			return time.Duration(seconds) * time.Second
+			return time.Duration(seconds) * time.Second, "s-maxage"
 		}
 	}
 	// Cache-Control max-age
@@ -49,28 +97,28 @@ func getExplicitFreshnessLifetime(headerStruct *ParsedHeaders) time.Duration {
 	if hasMaxAge {
 		seconds, err := strconv.Atoi(maxAge)
 		if err == nil && seconds >= 0 {
-			return time.Duration(seconds) * time.Second
+			return time.Duration(seconds) * time.Second, "max-age"
 		}
 	}
 	// Fallback: Expires - Date
 	dateStr, hasDate := headerStruct.GetValue("Date")
 	expStr, hasExp := headerStruct.GetValue("Expires")
 	if !hasDate || !hasExp {
-		return 0
+		return 0, ""
 	}
 	if dateStr[0] == "" || expStr[0] == "" {
-		return 0
+		return 0, ""
 	}
 	dateTime, err1 := http.ParseTime(dateStr[0])
 	expTime, err2 := http.ParseTime(expStr[0])
 	if err1 != nil || err2 != nil {
-		return 0
+		return 0, ""
 	}
 	d := expTime.Sub(dateTime)
 	if d < 0 {
-		return 0
+		return 0, "Expires"
 	}
-	return d
+	return d, "Expires"
 }
 
 func hasExplicitFreshness(headerStruct *ParsedHeaders) bool {
@@ -71,3 +71,39 @@ func TestGetFreshnessLifetimeForStatusRejectsNonHeuristicallyCacheableStatus(t *
 		t.Fatalf("freshness lifetime = %v, want 0", got)
 	}
 }
+
+func TestIsFreshFalseOnceInvalidated(t *testing.T) {
+	resp := &CachedResponse{
+		StatusCode:     http.StatusOK,
+		ResponseHeader: http.Header{"Cache-Control": []string{"max-age=600, stale-while-revalidate=60"}},
+		StoredAt:       time.Now(),
+	}
+	if !IsFresh(resp) {
+		t.Fatalf("response should be fresh before invalidation")
+	}
+	resp.InvalidatedAt = time.Now().Add(-10 * time.Second)
+	if IsFresh(resp) {
+		t.Errorf("invalidated response is still fresh")
+	}
+	if got := Staleness(resp); got < 10*time.Second {
+		t.Errorf("staleness = %v, want at least 10s", got)
+	}
+	if !StaleWhileRevalidate(resp) {
+		t.Errorf("response within stale-while-revalidate should be servable")
+	}
+	resp.InvalidatedAt = time.Now().Add(-2 * time.Minute)
+	if StaleWhileRevalidate(resp) {
+		t.Errorf("response past stale-while-revalidate should not be servable")
+	}
+}
+
+func TestStaleIfErrorHonorsMustRevalidate(t *testing.T) {
+	resp := &CachedResponse{
+		StatusCode:     http.StatusOK,
+		ResponseHeader: http.Header{"Cache-Control": []string{"max-age=0, stale-if-error=600, must-revalidate"}},
+		StoredAt:       time.Now().Add(-time.Minute),
+	}
+	if StaleIfError(resp) {
+		t.Errorf("must-revalidate response served stale on error")
+	}
+}
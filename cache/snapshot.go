@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A snapshot is a gzip stream holding
+//
+//	magic "KYCS" | version byte | (0x01 entry)* | 0x00 | entry count (uvarint)
+//
+// where each entry uses the EncodeEntry format. The trailing count lets
+// ReadSnapshot tell a complete archive from a truncated one.
+const (
+	snapshotMagic   = "KYCS"
+	snapshotVersion = 1
+
+	snapshotEntry = 0x01
+	snapshotEnd   = 0x00
+)
+
+var ErrTruncatedSnapshot = errors.New("cache: truncated snapshot")
+
+// WriteSnapshot writes every entry in store to w and returns how many were
+// written.
+func WriteSnapshot(w io.Writer, store Store) (int, error) {
+	zw := gzip.NewWriter(w)
+	bw := bufio.NewWriter(zw)
+	if _, err := bw.WriteString(snapshotMagic); err != nil {
+		return 0, err
+	}
+	if err := bw.WriteByte(snapshotVersion); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	var err error
+	store.Range(func(key string, resp *CachedResponse) bool {
+		if err = bw.WriteByte(snapshotEntry); err != nil {
+			return false
+		}
+		if err = EncodeEntry(bw, key, resp); err != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		return count, err
+	}
+
+	var trailer [1 + binary.MaxVarintLen64]byte
+	trailer[0] = snapshotEnd
+	n := binary.PutUvarint(trailer[1:], uint64(count))
+	if _, err := bw.Write(trailer[:1+n]); err != nil {
+		return count, err
+	}
+	if err := bw.Flush(); err != nil {
+		return count, err
+	}
+	return count, zw.Close()
+}
+
+// ReadSnapshot loads the entries of a snapshot written by WriteSnapshot into
+// store, keeping their original StoredAt and InitialAge. It returns how many
+// entries were loaded; entries before a corrupt or truncated one are kept.
+func ReadSnapshot(r io.Reader, store Store) (int, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer zr.Close()
+	br := bufio.NewReader(zr)
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return 0, unexpected(err)
+	}
+	if string(magic) != snapshotMagic {
+		return 0, ErrBadMagic
+	}
+	version, err := br.ReadByte()
+	if err != nil {
+		return 0, unexpected(err)
+	}
+	if version != snapshotVersion {
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedVersion, version)
+	}
+
+	count := 0
+	for {
+		marker, err := br.ReadByte()
+		if err != nil {
+			return count, ErrTruncatedSnapshot
+		}
+		if marker == snapshotEnd {
+			break
+		}
+		if marker != snapshotEntry {
+			return count, fmt.Errorf("cache: unexpected snapshot marker %#x", marker)
+		}
+		key, resp, err := DecodeEntry(br)
+		if err != nil {
+			return count, unexpected(err)
+		}
+		store.Set(key, resp)
+		count++
+	}
+
+	want, err := binary.ReadUvarint(br)
+	if err != nil {
+		return count, ErrTruncatedSnapshot
+	}
+	if want != uint64(count) {
+		return count, fmt.Errorf("cache: snapshot holds %d entries, trailer says %d", count, want)
+	}
+	return count, nil
+}
@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	src := NewCacheStore()
+	src.Set("a", newTestResponse("first"))
+	src.Set("b", newTestResponse("second"))
+
+	var buf bytes.Buffer
+	n, err := WriteSnapshot(&buf, src)
+	if err != nil || n != 2 {
+		t.Fatalf("WriteSnapshot() = %d, %v, want 2, nil", n, err)
+	}
+
+	dst := NewCacheStore()
+	n, err = ReadSnapshot(&buf, dst)
+	if err != nil || n != 2 {
+		t.Fatalf("ReadSnapshot() = %d, %v, want 2, nil", n, err)
+	}
+	got, ok := dst.Get("b")
+	if !ok {
+		t.Fatalf("b missing after restore")
+	}
+	want, _ := src.Get("b")
+	if string(got.Body) != "second" || !got.StoredAt.Equal(want.StoredAt) || got.InitialAge != want.InitialAge {
+		t.Errorf("restored entry = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadSnapshotRejectsTruncatedArchive(t *testing.T) {
+	src := NewCacheStore()
+	src.Set("a", newTestResponse("first"))
+
+	var buf bytes.Buffer
+	if _, err := WriteSnapshot(&buf, src); err != nil {
+		t.Fatalf("WriteSnapshot() error = %v", err)
+	}
+
+	// Re-compress the archive without its trailer.
+	raw := decompress(t, buf.Bytes())
+	var truncated bytes.Buffer
+	compress(t, &truncated, raw[:len(raw)-2])
+
+	if _, err := ReadSnapshot(&truncated, NewCacheStore()); !errors.Is(err, ErrTruncatedSnapshot) {
+		t.Fatalf("ReadSnapshot() error = %v, want %v", err, ErrTruncatedSnapshot)
+	}
+}
+
+func decompress(t *testing.T, data []byte) []byte {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func compress(t *testing.T, w io.Writer, data []byte) {
+	t.Helper()
+	zw := gzip.NewWriter(w)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,8 +1,12 @@
 package cache
 
 import (
+	"hash/maphash"
+	"maps"
 	"net/http"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -17,41 +21,219 @@ type CachedResponse struct {
 	ProtoMajor     int
 	ProtoMinor     int
 	Proto          string
+	// InvalidatedAt is set when the entry is soft purged. It is kept for
+	// revalidation and stale serving but never counts as fresh again.
+	InvalidatedAt time.Time
 }
 
+// Store is implemented by every cache backend. CacheStore keeps entries in
+// memory, DiskStore keeps them on disk and TieredStore combines the two.
+type Store interface {
+	Get(key string) (*CachedResponse, bool)
+	Set(key string, resp *CachedResponse)
+	// Delete removes key and reports whether it was present.
+	Delete(key string) bool
+	// Range calls fn for each stored entry until fn returns false.
+	Range(fn func(key string, resp *CachedResponse) bool)
+}
+
+// KeyRanger is implemented by stores that can list their keys without
+// loading the entries, such as DiskStore.
+type KeyRanger interface {
+	RangeKeys(fn func(key string) bool)
+}
+
+// Sizer is implemented by stores that can report how much they hold
+// without walking their entries. All stores in this package implement it.
+type Sizer interface {
+	// Len returns the number of entries.
+	Len() int
+	// Size returns the number of bytes the entries take up.
+	Size() int64
+}
+
+// SizeRanger is implemented by stores that know the size of each entry
+// without loading it. All stores in this package implement it.
+type SizeRanger interface {
+	// RangeSizes calls fn with each key and the bytes its entry takes up
+	// until fn returns false.
+	RangeSizes(fn func(key string, size int64) bool)
+}
+
+// EvictionNotifier is implemented by stores that drop entries on their own
+// to stay within a size budget, such as DiskStore and TieredStore.
+type EvictionNotifier interface {
+	// NotifyEvict makes the store call fn with the key of every entry it
+	// evicts. fn is called without the store's locks held.
+	NotifyEvict(fn func(key string))
+}
+
+// Peeker is implemented by stores whose Get leaves a trace, such as
+// refreshing the entry's recency, and that can look an entry up without it.
+type Peeker interface {
+	Peek(key string) (*CachedResponse, bool)
+}
+
+// Peek returns the entry for key without counting it as used.
+func Peek(store Store, key string) (*CachedResponse, bool) {
+	if p, ok := store.(Peeker); ok {
+		return p.Peek(key)
+	}
+	return store.Get(key)
+}
+
+// RangeKeys calls fn for each key in store until fn returns false.
+func RangeKeys(store Store, fn func(key string) bool) {
+	if kr, ok := store.(KeyRanger); ok {
+		kr.RangeKeys(fn)
+		return
+	}
+	store.Range(func(key string, _ *CachedResponse) bool {
+		return fn(key)
+	})
+}
+
+// cacheStoreShards is the number of independently locked maps in a
+// CacheStore. A Set only blocks Gets that hash to the same shard.
+const cacheStoreShards = 64
+
 type CacheStore struct {
+	seed   maphash.Seed
+	shards [cacheStoreShards]cacheShard
+}
+
+type cacheShard struct {
 	mu    sync.RWMutex
 	store map[string]*CachedResponse
+	size  int64
 }
 
 func NewCacheStore() *CacheStore {
-	return &CacheStore{store: make(map[string]*CachedResponse)}
+	cs := &CacheStore{seed: maphash.MakeSeed()}
+	for i := range cs.shards {
+		cs.shards[i].store = make(map[string]*CachedResponse)
+	}
+	return cs
+}
+
+func (cs *CacheStore) shard(key string) *cacheShard {
+	return &cs.shards[maphash.String(cs.seed, key)%cacheStoreShards]
 }
 
 func (cs *CacheStore) Get(key string) (*CachedResponse, bool) {
-	cs.mu.RLock()
-	defer cs.mu.RUnlock()
-	resp, ok := cs.store[key]
+	shard := cs.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	resp, ok := shard.store[key]
 	return resp, ok
 }
 
 func (cs *CacheStore) Set(key string, resp *CachedResponse) {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-	cs.store[key] = resp
+	shard := cs.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if old, ok := shard.store[key]; ok {
+		shard.size -= EntrySize(old)
+	}
+	shard.store[key] = resp
+	shard.size += EntrySize(resp)
+}
+
+func (cs *CacheStore) Delete(key string) bool {
+	shard := cs.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	old, ok := shard.store[key]
+	if ok {
+		shard.size -= EntrySize(old)
+		delete(shard.store, key)
+	}
+	return ok
+}
+
+// Len returns the number of entries in the store.
+func (cs *CacheStore) Len() int {
+	n := 0
+	for i := range cs.shards {
+		shard := &cs.shards[i]
+		shard.mu.RLock()
+		n += len(shard.store)
+		shard.mu.RUnlock()
+	}
+	return n
+}
+
+// Size returns the approximate number of bytes held by the entries.
+func (cs *CacheStore) Size() int64 {
+	var size int64
+	for i := range cs.shards {
+		shard := &cs.shards[i]
+		shard.mu.RLock()
+		size += shard.size
+		shard.mu.RUnlock()
+	}
+	return size
+}
+
+// EntrySize approximates the memory held by a cached response.
+func EntrySize(resp *CachedResponse) int64 {
+	size := int64(len(resp.Body))
+	for _, h := range []map[string][]string{resp.RequestHeader, resp.ResponseHeader} {
+		for k, vals := range h {
+			size += int64(len(k))
+			for _, v := range vals {
+				size += int64(len(v))
+			}
+		}
+	}
+	return size
+}
+
+// Range copies one shard at a time and calls fn without holding any lock,
+// so fn may modify the store. It does not observe a consistent snapshot of
+// the whole store.
+func (cs *CacheStore) Range(fn func(key string, resp *CachedResponse) bool) {
+	for i := range cs.shards {
+		for key, resp := range cs.shards[i].copy() {
+			if !fn(key, resp) {
+				return
+			}
+		}
+	}
+}
+
+// RangeSizes implements SizeRanger.
+func (cs *CacheStore) RangeSizes(fn func(key string, size int64) bool) {
+	cs.Range(func(key string, resp *CachedResponse) bool {
+		return fn(key, EntrySize(resp))
+	})
+}
+
+func (shard *cacheShard) copy() map[string]*CachedResponse {
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	return maps.Clone(shard.store)
 }
 
 // Comparing stored header and request header. see Section 4.1 for the detail
 // Assuming whitespace removal, capital normalization are done beforehand
 func HeadersMeetVaryConstraints(reqHeader, originalReqHeader, respHeader *ParsedHeaders) bool {
+	_, ok := varyMismatch(reqHeader, originalReqHeader, respHeader)
+	return ok
+}
+
+// varyMismatch reports whether the request headers meet the Vary
+// constraints of the stored response, and if not, the first field that
+// differs. The field is "*" for Vary: *.
+func varyMismatch(reqHeader, originalReqHeader, respHeader *ParsedHeaders) (string, bool) {
 	vary, hasVary := respHeader.GetValue("vary")
 	if !hasVary {
-		return true
+		return "", true
 	}
 	// If Vary header is "*", it means the response is not cacheable in the first place
 	// This should not happen in practice, but we handle it just in case
 	if respHeader.IsVaryWildcard() {
-		return false
+		return "*", false
 	}
 	for _, field := range vary {
 		reqVal, reqOk := reqHeader.GetValue(field)
@@ -60,84 +242,63 @@ func HeadersMeetVaryConstraints(reqHeader, originalReqHeader, respHeader *Parsed
 			continue
 		}
 		if reqOk != respOk {
-			return false
+			return field, false
 		}
 		if len(reqVal) != len(respVal) {
-			return false
+			return field, false
 		}
 		sort.Strings(reqVal)
 		sort.Strings(respVal)
 		for i := range reqVal {
 			if reqVal[i] != respVal[i] {
-				return false
+				return field, false
 			}
 		}
 	}
-	return true
+	return "", true
 }
 
 func IsReqAllowedToUseCache(reqHeader, originalReqHeader, respHeader *ParsedHeaders) bool {
-	// When Authorization header is present, the request cannot be responded with cache unless
-	// any of public, must-revalidate, or s-maxage directive is present in the response header.
-	_, reqHasAuthorization := reqHeader.GetDirectives("Authorization")
-	if reqHasAuthorization {
-		_, respHasPublic := respHeader.GetDirective("Cache-Control", "public")
-		_, respHasMustRevalidate := respHeader.GetDirective("Cache-Control", "must-revalidate")
-		_, respHasSMaxAge := respHeader.GetDirective("Cache-Control", "s-maxage")
-		if !respHasPublic && !respHasMustRevalidate && !respHasSMaxAge {
-			return false
-		}
-	}
-
-	if !HeadersMeetVaryConstraints(reqHeader, originalReqHeader, respHeader) {
-		return false
-	}
-	return true
+	ok, _ := ExplainReqAllowedToUseCache(reqHeader, originalReqHeader, respHeader)
+	return ok
 }
 
 func IsCacheable(method string, header *ParsedHeaders) bool {
-	if method != http.MethodGet {
-		return false
-	}
-	_, hasNoCache := header.GetDirective("Cache-Control", "no-cache")
-	if hasNoCache {
-		// TODO: Handle "no-cache" directive according to RFC 9111
-		// Need interpretation of the section 5.2.1.4.
-		return false
-	}
-	_, hasNoStore := header.GetDirective("Cache-Control", "no-store")
-	if hasNoStore {
-		return false
-	}
-	_, hasPrivate := header.GetDirective("Cache-Control", "private")
-	if hasPrivate {
-		return false
-	}
-
-	if header.IsVaryWildcard() {
-		// Vary: * means the response is not cacheable
-		return false
-	}
-
-	_, hasCdnNoCache := header.GetDirective("CDN-Cache-Control", "no-cache")
-	if hasCdnNoCache {
-		// TODO: Handle "no-cache" directive according to RFC 9111
-		return false
-	}
-	_, hasCdnNoStore := header.GetDirective("CDN-Cache-Control", "no-store")
-	if hasCdnNoStore {
-		return false
-	}
-	_, hasCdnPrivate := header.GetDirective("CDN-Cache-Control", "private")
-	if hasCdnPrivate {
-		return false
-	}
-
-	return true
+	ok, _ := ExplainCacheable(method, header)
+	return ok
 }
 
 func GenerateCacheKey(urlStr string, header *ParsedHeaders) string {
+	return GenerateCacheKeyForGeneration(urlStr, header, 0)
+}
+
+// GenerateCacheKeyForGeneration is GenerateCacheKey for a cache
+// generation. A non-zero generation is appended to the key, so moving to a
+// new generation hides every entry stored under an older one at once.
+func GenerateCacheKeyForGeneration(urlStr string, header *ParsedHeaders, generation uint64) string {
 	key := urlStr
 	// TODO: Append Vary header
+	if generation > 0 {
+		key += generationMarker + strconv.FormatUint(generation, 10)
+	}
 	return key
 }
+
+const generationMarker = "#g"
+
+// KeyGeneration returns the generation a key from
+// GenerateCacheKeyForGeneration was made with, and the URL it was made
+// from. Suffixes added after the generation, such as slice markers, are
+// ignored.
+func KeyGeneration(key string) (string, uint64) {
+	urlStr, rest, found := strings.Cut(key, "#")
+	if !found || !strings.HasPrefix("#"+rest, generationMarker) {
+		return urlStr, 0
+	}
+	digits, _, _ := strings.Cut(rest[len(generationMarker)-1:], "#")
+	generation, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return urlStr, 0
+	}
+	return urlStr, generation
+}
@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// lockedStore is the single-mutex store CacheStore replaced, kept here as a
+// baseline for the parallel benchmarks.
+type lockedStore struct {
+	mu    sync.RWMutex
+	store map[string]*CachedResponse
+}
+
+func (ls *lockedStore) Get(key string) (*CachedResponse, bool) {
+	ls.mu.RLock()
+	defer ls.mu.RUnlock()
+	resp, ok := ls.store[key]
+	return resp, ok
+}
+
+func (ls *lockedStore) Set(key string, resp *CachedResponse) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	ls.store[key] = resp
+}
+
+func TestCacheStoreGetSetRange(t *testing.T) {
+	cs := NewCacheStore()
+	for i := 0; i < 1000; i++ {
+		cs.Set(strconv.Itoa(i), &CachedResponse{StatusCode: i})
+	}
+
+	for i := 0; i < 1000; i++ {
+		resp, ok := cs.Get(strconv.Itoa(i))
+		if !ok || resp.StatusCode != i {
+			t.Fatalf("Get(%d) = %v, %v", i, resp, ok)
+		}
+	}
+
+	seen := 0
+	cs.Range(func(key string, resp *CachedResponse) bool {
+		seen++
+		return true
+	})
+	if seen != 1000 {
+		t.Errorf("Range() visited %d entries, want 1000", seen)
+	}
+}
+
+const benchKeys = 4096
+
+func benchmarkHitHeavy(b *testing.B, get func(string) (*CachedResponse, bool), set func(string, *CachedResponse)) {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = "https://example.com/assets/" + strconv.Itoa(i)
+		set(keys[i], &CachedResponse{StatusCode: 200})
+	}
+	var seq atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := int(seq.Add(1) * 7919)
+		for pb.Next() {
+			key := keys[i%benchKeys]
+			// One write per hundred reads, like a cache with a high hit ratio.
+			if i%100 == 0 {
+				set(key, &CachedResponse{StatusCode: 200})
+			} else {
+				get(key)
+			}
+			i++
+		}
+	})
+}
+
+// Run with -cpu=1,2,4,8 to see throughput scale with GOMAXPROCS.
+func BenchmarkCacheStoreParallelHitHeavy(b *testing.B) {
+	cs := NewCacheStore()
+	benchmarkHitHeavy(b, cs.Get, cs.Set)
+}
+
+func BenchmarkSingleLockStoreParallelHitHeavy(b *testing.B) {
+	ls := &lockedStore{store: make(map[string]*CachedResponse)}
+	benchmarkHitHeavy(b, ls.Get, ls.Set)
+}
+
+func TestCacheStoreLenAndSize(t *testing.T) {
+	store := NewCacheStore()
+	store.Set("a", &CachedResponse{Body: []byte("1234")})
+	store.Set("b", &CachedResponse{Body: []byte("12")})
+	store.Set("a", &CachedResponse{Body: []byte("123")})
+	if store.Len() != 2 || store.Size() != 5 {
+		t.Errorf("Len, Size = %d, %d, want 2, 5", store.Len(), store.Size())
+	}
+	store.Delete("a")
+	store.Delete("missing")
+	if store.Len() != 1 || store.Size() != 2 {
+		t.Errorf("after Delete: Len, Size = %d, %d, want 1, 2", store.Len(), store.Size())
+	}
+}
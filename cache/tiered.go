@@ -0,0 +1,410 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// TieredConfig sets the admission thresholds of a TieredStore.
+type TieredConfig struct {
+	// MemoryMaxBytes bounds the memory tier. Zero or less means unbounded.
+	MemoryMaxBytes int64
+	// MemoryMaxObjectSize keeps larger objects out of memory; they go
+	// straight to disk. Zero means no limit.
+	MemoryMaxObjectSize int64
+	// DiskMaxObjectSize keeps larger objects off disk, so they are dropped
+	// instead of demoted. Zero means no limit.
+	DiskMaxObjectSize int64
+	// PromoteAfterHits is how many disk hits an object needs before it is
+	// promoted back into memory. Zero or one promotes on the first hit.
+	PromoteAfterHits int
+}
+
+// TieredStore keeps hot objects in memory and demotes objects evicted from
+// memory to a DiskStore. Disk hits are promoted back into memory.
+type TieredStore struct {
+	disk   *DiskStore
+	config TieredConfig
+
+	// diskMu orders writes and deletes on the disk tier, so a demotion
+	// cannot land after a Delete of the same key.
+	diskMu sync.Mutex
+
+	mu    sync.Mutex
+	index map[string]*memoryEntry
+	lru   *list.List // front is most recently used
+	size  int64
+	// demoting holds entries evicted from memory until they are on disk, so
+	// they can still be found in the meantime.
+	demoting map[string]*memoryEntry
+	// diskHits counts hits on disk entries that are not promoted yet. Keys
+	// are dropped once they leave the disk.
+	diskHits map[string]int
+	onEvict  func(key string)
+}
+
+type memoryEntry struct {
+	key  string
+	resp *CachedResponse
+	size int64
+	// onDisk is set when the disk tier already holds this exact response,
+	// so evicting it from memory needs no write.
+	onDisk bool
+	elem   *list.Element
+}
+
+// NewTieredStore takes over disk: its evictions are reported through the
+// TieredStore.
+func NewTieredStore(disk *DiskStore, config TieredConfig) *TieredStore {
+	ts := &TieredStore{
+		disk:     disk,
+		config:   config,
+		index:    make(map[string]*memoryEntry),
+		lru:      list.New(),
+		demoting: make(map[string]*memoryEntry),
+		diskHits: make(map[string]int),
+	}
+	disk.NotifyEvict(ts.diskEvicted)
+	return ts
+}
+
+func fitsLimit(size, limit int64) bool {
+	return limit <= 0 || size <= limit
+}
+
+func (ts *TieredStore) Get(key string) (*CachedResponse, bool) {
+	ts.mu.Lock()
+	if entry, ok := ts.index[key]; ok {
+		ts.lru.MoveToFront(entry.elem)
+		ts.mu.Unlock()
+		return entry.resp, true
+	}
+	if entry, ok := ts.demoting[key]; ok {
+		ts.mu.Unlock()
+		return entry.resp, true
+	}
+	ts.mu.Unlock()
+
+	resp, ok := ts.disk.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	ts.mu.Lock()
+	promote := false
+	// The entry may have left the disk since it was read.
+	if ts.disk.contains(key) {
+		ts.diskHits[key]++
+		promote = ts.diskHits[key] >= ts.config.PromoteAfterHits
+		if promote {
+			delete(ts.diskHits, key)
+		}
+	}
+	ts.mu.Unlock()
+
+	if promote {
+		ts.promote(key, resp)
+	}
+	return resp, true
+}
+
+// Peek looks key up like Get without refreshing it in memory or counting a
+// disk hit towards promotion.
+func (ts *TieredStore) Peek(key string) (*CachedResponse, bool) {
+	ts.mu.Lock()
+	entry, ok := ts.index[key]
+	if !ok {
+		entry, ok = ts.demoting[key]
+	}
+	ts.mu.Unlock()
+	if ok {
+		return entry.resp, true
+	}
+	return ts.disk.Peek(key)
+}
+
+func (ts *TieredStore) Set(key string, resp *CachedResponse) {
+	size := EntrySize(resp)
+	if !fitsLimit(size, ts.config.MemoryMaxObjectSize) || !fitsLimit(size, ts.config.MemoryMaxBytes) {
+		ts.mu.Lock()
+		ts.removeMemoryLocked(key)
+		delete(ts.diskHits, key)
+		ts.mu.Unlock()
+		ts.diskMu.Lock()
+		stored := ts.setDisk(key, resp, size)
+		ts.diskMu.Unlock()
+		if !stored {
+			ts.evicted(key)
+		}
+		return
+	}
+
+	ts.mu.Lock()
+	ts.removeMemoryLocked(key)
+	delete(ts.diskHits, key)
+	ts.addMemoryLocked(key, resp, size, false)
+	evicted := ts.evictLocked()
+	ts.mu.Unlock()
+	ts.demote(evicted)
+}
+
+// promote brings a disk entry back into memory unless a newer version of it
+// got there first.
+func (ts *TieredStore) promote(key string, resp *CachedResponse) {
+	size := EntrySize(resp)
+	if !fitsLimit(size, ts.config.MemoryMaxObjectSize) || !fitsLimit(size, ts.config.MemoryMaxBytes) {
+		return
+	}
+	ts.mu.Lock()
+	if _, ok := ts.index[key]; ok {
+		ts.mu.Unlock()
+		return
+	}
+	if _, ok := ts.demoting[key]; ok {
+		ts.mu.Unlock()
+		return
+	}
+	ts.addMemoryLocked(key, resp, size, true)
+	evicted := ts.evictLocked()
+	ts.mu.Unlock()
+	ts.demote(evicted)
+}
+
+// demote writes entries evicted from memory to disk. Entries replaced or
+// deleted since they were evicted are skipped, and entries that do not fit
+// on disk count as evicted.
+func (ts *TieredStore) demote(entries []*memoryEntry) {
+	for _, e := range entries {
+		ts.diskMu.Lock()
+		ts.mu.Lock()
+		current := ts.demoting[e.key] == e
+		ts.mu.Unlock()
+		stored := current && ts.setDisk(e.key, e.resp, e.size)
+		ts.mu.Lock()
+		if ts.demoting[e.key] == e {
+			delete(ts.demoting, e.key)
+		}
+		ts.mu.Unlock()
+		ts.diskMu.Unlock()
+
+		if current && !stored {
+			ts.evicted(e.key)
+		}
+	}
+}
+
+// Range visits the memory tier first and then the disk entries that are not
+// also held in memory.
+func (ts *TieredStore) Range(fn func(key string, resp *CachedResponse) bool) {
+	entries := ts.memoryEntries()
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		seen[entry.key] = true
+		if !fn(entry.key, entry.resp) {
+			return
+		}
+	}
+	ts.disk.Range(func(key string, resp *CachedResponse) bool {
+		if seen[key] {
+			return true
+		}
+		return fn(key, resp)
+	})
+}
+
+// memoryEntries returns the entries in memory, including those on their
+// way to disk.
+func (ts *TieredStore) memoryEntries() []*memoryEntry {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	entries := make([]*memoryEntry, 0, len(ts.index)+len(ts.demoting))
+	for _, entry := range ts.index {
+		entries = append(entries, entry)
+	}
+	for _, entry := range ts.demoting {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (ts *TieredStore) Delete(key string) bool {
+	// Holding diskMu keeps a demotion in progress from bringing the key
+	// back after it is deleted.
+	ts.diskMu.Lock()
+	defer ts.diskMu.Unlock()
+	ts.mu.Lock()
+	_, inMemory := ts.index[key]
+	_, demoting := ts.demoting[key]
+	ts.removeMemoryLocked(key)
+	delete(ts.diskHits, key)
+	ts.mu.Unlock()
+	onDisk := ts.disk.Delete(key)
+	return inMemory || demoting || onDisk
+}
+
+func (ts *TieredStore) RangeKeys(fn func(key string) bool) {
+	entries := ts.memoryEntries()
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		seen[entry.key] = true
+		if !fn(entry.key) {
+			return
+		}
+	}
+	ts.disk.RangeKeys(func(key string) bool {
+		if seen[key] {
+			return true
+		}
+		return fn(key)
+	})
+}
+
+// RangeSizes implements SizeRanger, visiting the memory tier first and
+// then the disk entries that are not also held in memory.
+func (ts *TieredStore) RangeSizes(fn func(key string, size int64) bool) {
+	entries := ts.memoryEntries()
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		seen[entry.key] = true
+		if !fn(entry.key, entry.size) {
+			return
+		}
+	}
+	ts.disk.RangeSizes(func(key string, size int64) bool {
+		if seen[key] {
+			return true
+		}
+		return fn(key, size)
+	})
+}
+
+// setDisk stores resp on disk and reports whether it fit. diskMu must be
+// held.
+func (ts *TieredStore) setDisk(key string, resp *CachedResponse, size int64) bool {
+	if !fitsLimit(size, ts.config.DiskMaxObjectSize) {
+		// Make sure an older version cannot resurface from disk.
+		ts.disk.Delete(key)
+		return false
+	}
+	ts.disk.Set(key, resp)
+	return true
+}
+
+// NotifyEvict implements EvictionNotifier. Entries leaving memory count as
+// evicted only when they are dropped instead of demoted, and entries leaving
+// disk only when memory does not hold them.
+func (ts *TieredStore) NotifyEvict(fn func(key string)) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.onEvict = fn
+}
+
+// diskEvicted is called by the disk tier for every key it evicts.
+func (ts *TieredStore) diskEvicted(key string) {
+	ts.mu.Lock()
+	delete(ts.diskHits, key)
+	entry, inMemory := ts.index[key]
+	if inMemory {
+		// Memory now holds the only copy, so it must be demoted again
+		// rather than dropped.
+		entry.onDisk = false
+	}
+	ts.mu.Unlock()
+	if !inMemory {
+		ts.evicted(key)
+	}
+}
+
+func (ts *TieredStore) evicted(key string) {
+	ts.mu.Lock()
+	onEvict := ts.onEvict
+	ts.mu.Unlock()
+	if onEvict != nil {
+		onEvict(key)
+	}
+}
+
+func (ts *TieredStore) addMemoryLocked(key string, resp *CachedResponse, size int64, onDisk bool) {
+	entry := &memoryEntry{key: key, resp: resp, size: size, onDisk: onDisk}
+	entry.elem = ts.lru.PushFront(entry)
+	ts.index[key] = entry
+	ts.size += size
+}
+
+// removeMemoryLocked drops key from memory, including a demotion of it
+// that has not reached the disk yet.
+func (ts *TieredStore) removeMemoryLocked(key string) {
+	delete(ts.demoting, key)
+	if old, ok := ts.index[key]; ok {
+		ts.lru.Remove(old.elem)
+		delete(ts.index, key)
+		ts.size -= old.size
+	}
+}
+
+// evictLocked makes room in memory and returns the evicted entries that
+// need writing to disk; they stay in demoting until they are written.
+func (ts *TieredStore) evictLocked() []*memoryEntry {
+	if ts.config.MemoryMaxBytes <= 0 {
+		return nil
+	}
+	var evicted []*memoryEntry
+	for ts.size > ts.config.MemoryMaxBytes {
+		back := ts.lru.Back()
+		if back == nil {
+			break
+		}
+		entry := back.Value.(*memoryEntry)
+		ts.removeMemoryLocked(entry.key)
+		if !entry.onDisk {
+			ts.demoting[entry.key] = entry
+			evicted = append(evicted, entry)
+		}
+	}
+	return evicted
+}
+
+// Len returns the number of entries in either tier.
+func (ts *TieredStore) Len() int {
+	ts.mu.Lock()
+	memoryOnly := 0
+	for _, entry := range ts.index {
+		if !ts.disk.contains(entry.key) {
+			memoryOnly++
+		}
+	}
+	for _, entry := range ts.demoting {
+		if !ts.disk.contains(entry.key) {
+			memoryOnly++
+		}
+	}
+	ts.mu.Unlock()
+	return ts.disk.Len() + memoryOnly
+}
+
+// Size returns the bytes stored on disk plus the approximate size of the
+// entries held only in memory. A key with an older version on disk counts
+// only there.
+func (ts *TieredStore) Size() int64 {
+	ts.mu.Lock()
+	var memoryOnly int64
+	for _, entry := range ts.index {
+		if !ts.disk.contains(entry.key) {
+			memoryOnly += entry.size
+		}
+	}
+	for _, entry := range ts.demoting {
+		if !ts.disk.contains(entry.key) {
+			memoryOnly += entry.size
+		}
+	}
+	ts.mu.Unlock()
+	return ts.disk.Size() + memoryOnly
+}
+
+// MemorySize returns the approximate number of bytes held in memory.
+func (ts *TieredStore) MemorySize() int64 {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.size
+}
@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"slices"
+	"testing"
+)
+
+func newTestTieredStore(t *testing.T, config TieredConfig) (*TieredStore, *DiskStore) {
+	t.Helper()
+	disk, err := NewDiskStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("NewDiskStore() error = %v", err)
+	}
+	return NewTieredStore(disk, config), disk
+}
+
+func TestTieredStoreDemotesEvictedObjects(t *testing.T) {
+	size := EntrySize(newTestResponse("0123456789"))
+	ts, disk := newTestTieredStore(t, TieredConfig{MemoryMaxBytes: 2 * size})
+
+	ts.Set("a", newTestResponse("0123456789"))
+	ts.Set("b", newTestResponse("0123456789"))
+	if disk.Len() != 0 {
+		t.Fatalf("disk.Len() = %d before memory is full, want 0", disk.Len())
+	}
+
+	ts.Set("c", newTestResponse("0123456789"))
+	if _, ok := ts.index["a"]; ok {
+		t.Errorf("a should have left the memory tier")
+	}
+	if _, ok := disk.Get("a"); !ok {
+		t.Errorf("a should have been demoted to disk")
+	}
+	if _, ok := ts.Get("a"); !ok {
+		t.Errorf("Get(a) should be served from disk")
+	}
+}
+
+func TestTieredStorePromotesAfterHits(t *testing.T) {
+	ts, disk := newTestTieredStore(t, TieredConfig{PromoteAfterHits: 2})
+	disk.Set("a", newTestResponse("payload"))
+
+	if _, ok := ts.Get("a"); !ok {
+		t.Fatalf("Get(a) missing")
+	}
+	if _, ok := ts.index["a"]; ok {
+		t.Fatalf("a promoted after one hit, want two")
+	}
+	ts.Get("a")
+	if _, ok := ts.index["a"]; !ok {
+		t.Fatalf("a not promoted after two hits")
+	}
+}
+
+func TestTieredStorePeekLeavesNoTrace(t *testing.T) {
+	ts, disk := newTestTieredStore(t, TieredConfig{PromoteAfterHits: 1})
+	disk.Set("a", newTestResponse("payload"))
+
+	for range 2 {
+		if resp, ok := ts.Peek("a"); !ok || string(resp.Body) != "payload" {
+			t.Fatalf("Peek(a) = %v, %v", resp, ok)
+		}
+	}
+	if _, ok := ts.index["a"]; ok {
+		t.Errorf("Peek promoted a")
+	}
+	if n := ts.diskHits["a"]; n != 0 {
+		t.Errorf("Peek counted %d disk hits", n)
+	}
+}
+
+func TestTieredStoreAdmissionBySize(t *testing.T) {
+	small := newTestResponse("small")
+	large := newTestResponse("a considerably larger body")
+	ts, disk := newTestTieredStore(t, TieredConfig{
+		MemoryMaxObjectSize: EntrySize(small),
+		DiskMaxObjectSize:   EntrySize(small),
+	})
+
+	ts.Set("small", small)
+	ts.Set("large", large)
+
+	if _, ok := ts.index["small"]; !ok {
+		t.Errorf("small object should be in memory")
+	}
+	if _, ok := ts.Get("large"); ok {
+		t.Errorf("large object should be admitted to neither tier")
+	}
+	if disk.Len() != 0 {
+		t.Errorf("disk.Len() = %d, want 0", disk.Len())
+	}
+}
+
+func TestTieredStoreForgetsDiskHitsOfEvictedKeys(t *testing.T) {
+	size := EntrySize(newTestResponse("0123456789"))
+	disk, err := NewDiskStore(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := NewTieredStore(disk, TieredConfig{PromoteAfterHits: 3, MemoryMaxObjectSize: size - 1})
+	ts.Set("a", newTestResponse("0123456789"))
+	ts.Get("a")
+	if ts.diskHits["a"] != 1 {
+		t.Fatalf("diskHits[a] = %d, want 1", ts.diskHits["a"])
+	}
+
+	disk.maxBytes = 1
+	ts.Set("b", newTestResponse("0123456789"))
+	if len(ts.diskHits) != 0 {
+		t.Errorf("diskHits = %v after the disk evicted a", ts.diskHits)
+	}
+}
+
+func TestTieredStoreCountsReplacedPromotionsOnce(t *testing.T) {
+	ts, _ := newTestTieredStore(t, TieredConfig{})
+	ts.disk.Set("a", newTestResponse("old"))
+	ts.Get("a") // promoted, still on disk
+	ts.Set("a", newTestResponse("new"))
+
+	if n := ts.Len(); n != 1 {
+		t.Errorf("Len() = %d, want 1", n)
+	}
+	if size, want := ts.Size(), ts.disk.Size(); size != want {
+		t.Errorf("Size() = %d, want %d", size, want)
+	}
+}
+
+func TestTieredStoreDemotesPromotedEntriesTheDiskEvicted(t *testing.T) {
+	size := EntrySize(newTestResponse("0123456789"))
+	ts, disk := newTestTieredStore(t, TieredConfig{MemoryMaxBytes: 2 * size})
+	var evicted []string
+	ts.NotifyEvict(func(key string) { evicted = append(evicted, key) })
+
+	disk.Set("a", newTestResponse("0123456789"))
+	ts.Get("a") // promoted
+	disk.maxBytes = size
+	disk.Set("b", newTestResponse("0123456789")) // evicts a from disk
+	ts.Set("c", newTestResponse("0123456789"))
+	ts.Set("d", newTestResponse("0123456789")) // evicts a from memory
+
+	if _, ok := ts.Get("a"); !ok && !slices.Contains(evicted, "a") {
+		t.Errorf("a left both tiers without an eviction notification; evicted = %v", evicted)
+	}
+}
+
+func TestTieredStoreDemotionSkipsDeletedEntries(t *testing.T) {
+	ts, disk := newTestTieredStore(t, TieredConfig{})
+	entry := &memoryEntry{key: "a", resp: newTestResponse("payload")}
+	ts.demoting["a"] = entry
+
+	if _, ok := ts.Get("a"); !ok {
+		t.Errorf("Get(a) missed an entry on its way to disk")
+	}
+	if !ts.Delete("a") {
+		t.Errorf("Delete(a) = false for an entry on its way to disk")
+	}
+	ts.demote([]*memoryEntry{entry})
+	if _, ok := disk.Get("a"); ok {
+		t.Errorf("demotion brought a deleted entry back")
+	}
+}
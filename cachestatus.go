@@ -0,0 +1,66 @@
+package kyache
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+// Cache-Status (RFC 9211) identifies this cache and, for forwarded requests,
+// why the request went to the origin.
+const (
+	cacheStatusName = "kyache"
+
+	fwdURIMiss = "uri-miss"
+	fwdMiss    = "miss"
+	fwdStale   = "stale"
+	fwdMethod  = "method"
+)
+
+// addCacheStatus appends this cache's member after any members added by
+// caches closer to the origin.
+func addCacheStatus(h http.Header, value string) {
+	h.Add("Cache-Status", value)
+}
+
+func cacheStatusHit(cachedResp *cache.CachedResponse) string {
+	return cacheStatusName + "; hit; ttl=" + strconv.Itoa(remainingTTL(cachedResp))
+}
+
+// remainingTTL returns the seconds cachedResp stays fresh for, or minus the
+// seconds it has been stale for.
+func remainingTTL(cachedResp *cache.CachedResponse) int {
+	if !cache.IsFresh(cachedResp) {
+		return -int(cache.Staleness(cachedResp).Seconds())
+	}
+	header := cache.NewParsedHeaders(cachedResp.ResponseHeader)
+	lifetime := cache.GetFreshnessLifetimeForStatus(header, cachedResp.StatusCode)
+	return int(lifetime.Seconds()) - cache.GetCurrentAge(cachedResp)
+}
+
+// cacheStatusRevalidating marks a stale response served while it is
+// revalidated in the background.
+func cacheStatusRevalidating(cachedResp *cache.CachedResponse) string {
+	return cacheStatusHit(cachedResp) + "; detail=stale-while-revalidate"
+}
+
+// cacheStatusStaleIfError marks a stale response served because the origin
+// failed. status is zero when no response was received.
+func cacheStatusStaleIfError(status int) string {
+	value := cacheStatusName + "; fwd=" + fwdStale
+	if status != 0 {
+		value += "; fwd-status=" + strconv.Itoa(status)
+	}
+	return value + "; detail=stale-if-error"
+}
+
+func cacheStatusForward(fwd string, status int) string {
+	return cacheStatusName + "; fwd=" + fwd + "; fwd-status=" + strconv.Itoa(status)
+}
+
+// cacheStatusCollapsed marks a response that was served from the fill of a
+// concurrent request for the same key.
+func cacheStatusCollapsed(fwd string) string {
+	return cacheStatusName + "; fwd=" + fwd + "; collapsed"
+}
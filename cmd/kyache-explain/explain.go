@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+// explain writes what kyache would do with ex.response, using the same
+// checks as the cache.
+func explain(w io.Writer, ex exchange) {
+	method := http.MethodGet
+	if ex.request != nil {
+		method = ex.request.method
+		if ex.request.url != "" {
+			fmt.Fprintf(w, "%s %s\n", method, ex.request.url)
+		}
+	}
+	resp := ex.response
+	respHeader := cache.NewParsedHeaders(resp.header)
+
+	cacheable, why := cache.ExplainCacheable(method, respHeader)
+	fmt.Fprintf(w, "status:    %d\n", resp.status)
+	fmt.Fprintf(w, "store:     %s\n", yesNo(cacheable, why))
+
+	f := cache.ExplainFreshness(&cache.CachedResponse{
+		StatusCode:     resp.status,
+		ResponseHeader: resp.header,
+		StoredAt:       time.Now(),
+		InitialAge:     respHeader.GetValidatedAge(),
+	})
+	switch {
+	case f.Heuristic:
+		fmt.Fprintf(w, "freshness: heuristic, 10%% of the time between Last-Modified and Date\n")
+	case f.Source != "":
+		fmt.Fprintf(w, "freshness: explicit, from %s\n", f.Source)
+	default:
+		fmt.Fprintf(w, "freshness: none, every use is revalidated with the origin\n")
+	}
+	fmt.Fprintf(w, "           %s\n", f)
+
+	fmt.Fprintf(w, "vary:      %s\n", varyConstraints(respHeader, ex.request))
+	if ex.request != nil {
+		reqHeader := cache.NewParsedHeaders(ex.request.header)
+		ok, why := cache.ExplainReqAllowedToUseCache(reqHeader, reqHeader, respHeader)
+		fmt.Fprintf(w, "reuse:     %s\n", yesNo(ok, why))
+	}
+}
+
+func yesNo(ok bool, why string) string {
+	if ok {
+		return "yes"
+	}
+	return "no, " + why
+}
+
+// varyConstraints lists the request headers a stored response is keyed on,
+// with their values in req when it is known.
+func varyConstraints(respHeader *cache.ParsedHeaders, req *request) string {
+	vary, ok := respHeader.GetValue("Vary")
+	if !ok || len(vary) == 0 {
+		return "none"
+	}
+	if respHeader.IsVaryWildcard() {
+		return "*, never reused"
+	}
+	constraints := make([]string, 0, len(vary))
+	for _, field := range vary {
+		field = http.CanonicalHeaderKey(field)
+		if req == nil {
+			constraints = append(constraints, field)
+			continue
+		}
+		values := req.header.Values(field)
+		if len(values) == 0 {
+			constraints = append(constraints, field+" (absent)")
+			continue
+		}
+		constraints = append(constraints, fmt.Sprintf("%s=%q", field, strings.Join(values, ", ")))
+	}
+	return strings.Join(constraints, ", ")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExplainHAREntry(t *testing.T) {
+	har := []byte(`{"log": {"entries": [{
+		"request": {"method": "GET", "url": "https://example.com/news", "headers": [
+			{"name": ":authority", "value": "example.com"},
+			{"name": "accept-language", "value": "ja"}
+		]},
+		"response": {"status": 200, "headers": [
+			{"name": "cache-control", "value": "s-maxage=600, max-age=60"},
+			{"name": "vary", "value": "Accept-Language, Accept-Encoding"}
+		]}
+	}]}}`)
+	exchanges, err := parseHAR(har)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	explain(&out, exchanges[0])
+
+	want := `GET https://example.com/news
+status:    200
+store:     yes
+freshness: explicit, from s-maxage
+           freshness 10m from s-maxage, fresh for 10m
+vary:      Accept-Language="ja", Accept-Encoding (absent)
+reuse:     yes
+`
+	if out.String() != want {
+		t.Errorf("explain =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestParseRawHeaders(t *testing.T) {
+	resp, err := parseResponse([]byte("HTTP/1.1 404 Not Found\r\nCache-Control: private\r\n\r\nbody"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.status != 404 || resp.header.Get("Cache-Control") != "private" {
+		t.Errorf("parseResponse = %+v", resp)
+	}
+
+	resp, err = parseResponse([]byte("Expires: Thu, 01 Jan 1970 00:00:00 GMT\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.status != 200 || resp.header.Get("Expires") == "" {
+		t.Errorf("parseResponse without status line = %+v", resp)
+	}
+
+	req, err := parseRequest([]byte("POST /form HTTP/1.1\nAuthorization: Basic eDp5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.method != "POST" || req.url != "/form" || req.header.Get("Authorization") == "" {
+		t.Errorf("parseRequest = %+v", req)
+	}
+}
+
+func TestParseRequestLine(t *testing.T) {
+	tests := []struct {
+		input       string
+		method, url string
+		header      string // the first header, which must not be taken for the request line
+	}{
+		{"GET https://example.com/x HTTP/1.1\nAccept: text/html\n", "GET", "https://example.com/x", "Accept"},
+		{"GET http://example.com:8080/x\nAccept: text/html\n", "GET", "http://example.com:8080/x", "Accept"},
+		{"Accept: text/html, application/json\nCookie: a=b\n", "GET", "", "Accept"},
+		{"Host: example.com\n", "GET", "", "Host"},
+	}
+	for _, tt := range tests {
+		req, err := parseRequest([]byte(tt.input))
+		if err != nil {
+			t.Errorf("parseRequest(%q) error = %v", tt.input, err)
+			continue
+		}
+		if req.method != tt.method || req.url != tt.url || req.header.Get(tt.header) == "" {
+			t.Errorf("parseRequest(%q) = %+v", tt.input, req)
+		}
+	}
+}
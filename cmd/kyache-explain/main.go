@@ -0,0 +1,97 @@
+// Command kyache-explain reports what kyache would do with a response: if it
+// would be stored, how long it stays fresh and why, and what its Vary header
+// keys it on. It reads raw response headers, optionally preceded by a status
+// line, or every entry of a HAR file.
+//
+//	curl -sI https://example.com/ | kyache-explain
+//	kyache-explain -request req.txt resp.txt
+//	kyache-explain -url /api/ site.har
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+var requestFile = flag.String("request", "", "File with the raw request headers, to check Authorization and show Vary values")
+var harInput = flag.Bool("har", false, "Read a HAR file; implied by a .har file name")
+var urlFilter = flag.String("url", "", "Only explain HAR entries whose URL contains this")
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("kyache-explain: ")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: kyache-explain [flags] [file]\n\nReads stdin when file is omitted or \"-\".\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() > 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	name := flag.Arg(0)
+	input, err := readInput(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var exchanges []exchange
+	if *harInput || strings.HasSuffix(name, ".har") {
+		exchanges, err = parseHAR(input)
+		if err != nil {
+			log.Fatal(err)
+		}
+		exchanges = filterURL(exchanges, *urlFilter)
+		if len(exchanges) == 0 {
+			log.Fatal("no HAR entries to explain")
+		}
+	} else {
+		resp, err := parseResponse(input)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ex := exchange{response: resp}
+		if *requestFile != "" {
+			input, err := os.ReadFile(*requestFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if ex.request, err = parseRequest(input); err != nil {
+				log.Fatal(err)
+			}
+		}
+		exchanges = []exchange{ex}
+	}
+
+	for i, ex := range exchanges {
+		if i > 0 {
+			fmt.Println()
+		}
+		explain(os.Stdout, ex)
+	}
+}
+
+func readInput(name string) ([]byte, error) {
+	if name == "" || name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
+
+func filterURL(exchanges []exchange, substr string) []exchange {
+	if substr == "" {
+		return exchanges
+	}
+	var filtered []exchange
+	for _, ex := range exchanges {
+		if strings.Contains(ex.request.url, substr) {
+			filtered = append(filtered, ex)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// exchange is a response to explain and, if known, the request it answered.
+type exchange struct {
+	request  *request
+	response response
+}
+
+type request struct {
+	method string
+	url    string
+	header http.Header
+}
+
+type response struct {
+	status int
+	header http.Header
+}
+
+// parseResponse parses raw response headers. The status line is optional;
+// without one the status is 200.
+func parseResponse(input []byte) (response, error) {
+	first, header, err := parseHeaders(input, func(line string) bool {
+		return strings.HasPrefix(line, "HTTP/")
+	})
+	if err != nil {
+		return response{}, err
+	}
+	resp := response{status: http.StatusOK, header: header}
+	if first != "" {
+		// "HTTP/1.1 200 OK" or "HTTP/2 200"
+		fields := strings.Fields(first)
+		if len(fields) < 2 {
+			return response{}, fmt.Errorf("malformed status line %q", first)
+		}
+		if resp.status, err = strconv.Atoi(fields[1]); err != nil {
+			return response{}, fmt.Errorf("malformed status line %q", first)
+		}
+	}
+	return resp, nil
+}
+
+// parseRequest parses raw request headers. The request line is optional;
+// without one the method is GET.
+func parseRequest(input []byte) (*request, error) {
+	first, header, err := parseHeaders(input, isRequestLine)
+	if err != nil {
+		return nil, err
+	}
+	req := &request{method: http.MethodGet, header: header}
+	if first != "" {
+		// "GET /path HTTP/1.1"
+		fields := strings.Fields(first)
+		req.method = fields[0]
+		if len(fields) > 1 {
+			req.url = fields[1]
+		}
+	}
+	return req, nil
+}
+
+// isRequestLine reports whether line is a request line such as "GET /path
+// HTTP/1.1" or "GET https://example.com/path", rather than a header. A
+// method is a token, which a header name followed by its colon is not.
+func isRequestLine(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 || !isToken(fields[0]) {
+		return false
+	}
+	return len(fields) == 2 || strings.HasPrefix(fields[2], "HTTP/")
+}
+
+// isToken reports whether s is a token as defined by RFC 9110.
+func isToken(s string) bool {
+	for _, c := range []byte(s) {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// parseHeaders reads a header block preceded by an optional first line,
+// which isFirst recognizes. Headers end at the first empty line or the end
+// of input.
+func parseHeaders(input []byte, isFirst func(line string) bool) (string, http.Header, error) {
+	input = bytes.TrimLeft(input, " \t\r\n")
+	line, _, _ := bytes.Cut(input, []byte("\n"))
+	first := strings.TrimSpace(string(line))
+	if first != "" && isFirst(first) {
+		input = input[len(line):]
+		input = bytes.TrimPrefix(input, []byte("\n"))
+	} else {
+		first = ""
+	}
+
+	r := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(input), strings.NewReader("\r\n\r\n"))))
+	header, err := r.ReadMIMEHeader()
+	if err != nil {
+		return "", nil, fmt.Errorf("reading headers: %w", err)
+	}
+	return first, http.Header(header), nil
+}
+
+// HAR 1.2, as far as it is needed here.
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method  string      `json:"method"`
+				URL     string      `json:"url"`
+				Headers []harHeader `json:"headers"`
+			} `json:"request"`
+			Response struct {
+				Status  int         `json:"status"`
+				Headers []harHeader `json:"headers"`
+			} `json:"response"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func parseHAR(input []byte) ([]exchange, error) {
+	var har harFile
+	if err := json.Unmarshal(input, &har); err != nil {
+		return nil, fmt.Errorf("reading HAR: %w", err)
+	}
+	if har.Log.Entries == nil {
+		return nil, errors.New("reading HAR: no log entries")
+	}
+	exchanges := make([]exchange, 0, len(har.Log.Entries))
+	for _, entry := range har.Log.Entries {
+		exchanges = append(exchanges, exchange{
+			request: &request{
+				method: entry.Request.Method,
+				url:    entry.Request.URL,
+				header: harHeaders(entry.Request.Headers),
+			},
+			response: response{
+				status: entry.Response.Status,
+				header: harHeaders(entry.Response.Headers),
+			},
+		})
+	}
+	return exchanges, nil
+}
+
+// harHeaders converts HAR headers, leaving out HTTP/2 pseudo-headers such
+// as ":status".
+func harHeaders(headers []harHeader) http.Header {
+	h := make(http.Header, len(headers))
+	for _, hh := range headers {
+		if strings.HasPrefix(hh.Name, ":") {
+			continue
+		}
+		h.Add(hh.Name, hh.Value)
+	}
+	return h
+}
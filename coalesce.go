@@ -0,0 +1,135 @@
+package kyache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+// DefaultCollapseTimeout is used when Config.CollapseTimeout is zero.
+const DefaultCollapseTimeout = 5 * time.Second
+
+// fill is an origin fetch that concurrent misses for the same cache key wait
+// on instead of going to the origin themselves.
+type fill struct {
+	// ready is closed once the leader has the response headers. partial is
+	// set before that when waiters may follow the body as it arrives.
+	ready   chan struct{}
+	partial *partialEntry
+	once    sync.Once
+
+	// done is closed once the leader is finished; stored is written before
+	// that and tells waiters whether the response ended up in the cache.
+	done     chan struct{}
+	stored   bool
+	finished sync.Once
+}
+
+// partialEntry is a response whose body is still being fetched. resp holds
+// the status line and headers; the body grows in body.
+type partialEntry struct {
+	resp *cache.CachedResponse
+	body *cache.ChunkedBody
+}
+
+// fillResult is what a waiter learns from the leader of a fill.
+type fillResult struct {
+	partial *partialEntry
+	stored  bool
+}
+
+type fillGroup struct {
+	mu    sync.Mutex
+	fills map[string]*fill
+}
+
+func newFillGroup() *fillGroup {
+	return &fillGroup{fills: make(map[string]*fill)}
+}
+
+// join returns the fill in flight for key, or starts one. The caller that
+// starts a fill is its leader and must call finish.
+func (g *fillGroup) join(key string) (*fill, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.fills[key]; ok {
+		return f, false
+	}
+	f := &fill{ready: make(chan struct{}), done: make(chan struct{})}
+	g.fills[key] = f
+	return f, true
+}
+
+// finish releases the waiters of f. Only the first call counts, so a
+// leader may finish early, before streaming a body nobody else can use.
+func (g *fillGroup) finish(key string, f *fill, stored bool) {
+	g.mu.Lock()
+	if g.fills[key] == f {
+		delete(g.fills, key)
+	}
+	g.mu.Unlock()
+	f.publish(nil)
+	f.finished.Do(func() {
+		f.stored = stored
+		close(f.done)
+	})
+}
+
+// publish releases waiters blocked on the response headers. A nil partial
+// tells them to wait for the fill to finish instead of attaching to it.
+func (f *fill) publish(partial *partialEntry) {
+	f.once.Do(func() {
+		f.partial = partial
+		close(f.ready)
+	})
+}
+
+// joinFill starts or joins the fill for key. Leaders get the fill back and
+// must finish it. Waiters block until the leader publishes a partial entry
+// or finishes, the collapse timeout passes, or ctx is cancelled. With
+// collapsing disabled every caller leads an untracked fill.
+func (cs *CacheServer) joinFill(ctx context.Context, key string) (*fill, bool, fillResult) {
+	if cs.collapseTimeout < 0 {
+		return nil, true, fillResult{}
+	}
+	f, leader := cs.fills.join(key)
+	if leader {
+		return f, true, fillResult{}
+	}
+
+	timer := time.NewTimer(cs.collapseTimeout)
+	defer timer.Stop()
+	select {
+	case <-f.ready:
+		if f.partial != nil {
+			return nil, false, fillResult{partial: f.partial}
+		}
+	case <-timer.C:
+		return nil, false, fillResult{}
+	case <-ctx.Done():
+		return nil, false, fillResult{}
+	}
+	select {
+	case <-f.done:
+		return nil, false, fillResult{stored: f.stored}
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return nil, false, fillResult{}
+}
+
+// publishFill and finishFill are no-ops for the nil fills handed out when
+// collapsing is disabled or the caller was released to fetch on its own.
+func (cs *CacheServer) publishFill(f *fill, partial *partialEntry) {
+	if f != nil {
+		f.publish(partial)
+	}
+}
+
+func (cs *CacheServer) finishFill(key string, f *fill, stored bool) {
+	if f != nil {
+		cs.fills.finish(key, f, stored)
+	}
+}
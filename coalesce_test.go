@@ -0,0 +1,169 @@
+package kyache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveConcurrently sends n requests for path through handler at once and
+// returns their recorders.
+func serveConcurrently(handler http.Handler, path string, n int) []*httptest.ResponseRecorder {
+	recorders := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		}(recorders[i])
+	}
+	wg.Wait()
+	return recorders
+}
+
+func TestConcurrentMissesAreCollapsed(t *testing.T) {
+	var originHits atomic.Int32
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		originHits.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("popular"))
+	})
+	handler := New(&Config{}).Handler(originURL)
+
+	recorders := serveConcurrently(handler, "/popular", 10)
+
+	if got := originHits.Load(); got != 1 {
+		t.Errorf("origin hits = %d, want 1", got)
+	}
+	collapsed := 0
+	for _, w := range recorders {
+		if w.Body.String() != "popular" {
+			t.Errorf("body = %q, want %q", w.Body.String(), "popular")
+		}
+		if strings.Contains(w.Header().Get("Cache-Status"), "collapsed") {
+			collapsed++
+		}
+	}
+	if collapsed == 0 {
+		t.Errorf("no response was labelled as collapsed")
+	}
+}
+
+func TestUncacheableResponsesReleaseWaiters(t *testing.T) {
+	start := time.Now()
+	arrivals := make(chan time.Duration, 2)
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		arrivals <- time.Since(start)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// Stall the body, not the headers, so only an early release lets
+		// the waiter through.
+		time.Sleep(500 * time.Millisecond)
+		w.Write([]byte("private"))
+	})
+	handler := New(&Config{}).Handler(originURL)
+
+	leader := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(leader, httptest.NewRequest("GET", "/private", nil))
+	}()
+	<-arrivals
+
+	waiter := httptest.NewRecorder()
+	handler.ServeHTTP(waiter, httptest.NewRequest("GET", "/private", nil))
+	<-done
+
+	if waited := <-arrivals; waited > 250*time.Millisecond {
+		t.Errorf("waiter reached the origin after %v, want it released once the leader saw no-store", waited)
+	}
+	for _, w := range []*httptest.ResponseRecorder{leader, waiter} {
+		if w.Body.String() != "private" {
+			t.Errorf("body = %q, want %q", w.Body.String(), "private")
+		}
+	}
+}
+
+func TestCollapsedWaitersTimeOut(t *testing.T) {
+	var originHits atomic.Int32
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		if originHits.Add(1) == 1 {
+			time.Sleep(300 * time.Millisecond)
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("slow"))
+	})
+	handler := New(&Config{CollapseTimeout: 20 * time.Millisecond}).Handler(originURL)
+
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/slow", nil))
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("waiter took %v, want it to give up after the collapse timeout", elapsed)
+	}
+	if w.Body.String() != "slow" {
+		t.Errorf("body = %q, want %q", w.Body.String(), "slow")
+	}
+	if got := originHits.Load(); got != 2 {
+		t.Errorf("origin hits = %d, want 2", got)
+	}
+}
+
+func TestCollapsedRequestsFollowInProgressFill(t *testing.T) {
+	release := make(chan struct{})
+	var originHits atomic.Int32
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		originHits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Length", "10")
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("world"))
+	})
+	proxy := httptest.NewServer(New(&Config{}).Handler(originURL))
+	defer proxy.Close()
+
+	leader, err := http.Get(proxy.URL + "/video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Body.Close()
+
+	follower, err := http.Get(proxy.URL + "/video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Body.Close()
+	if !strings.Contains(follower.Header.Get("Cache-Status"), "collapsed") {
+		t.Errorf("Cache-Status = %q, want collapsed", follower.Header.Get("Cache-Status"))
+	}
+
+	// The bytes received so far arrive before the origin has finished.
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(follower.Body, head); err != nil || string(head) != "hello" {
+		t.Fatalf("follower head = %q, %v", head, err)
+	}
+
+	close(release)
+	rest, err := io.ReadAll(follower.Body)
+	if err != nil || string(rest) != "world" {
+		t.Fatalf("follower rest = %q, %v", rest, err)
+	}
+	if got := originHits.Load(); got != 1 {
+		t.Errorf("origin hits = %d, want 1", got)
+	}
+}
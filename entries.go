@@ -0,0 +1,166 @@
+package kyache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+const (
+	defaultEntryListLimit = 100
+	maxEntryListLimit     = 1000
+)
+
+type entryList struct {
+	Keys []string `json:"keys"`
+	// Next is the after value for the following page, empty on the last.
+	Next string `json:"next,omitempty"`
+}
+
+// EntryInfo describes a stored entry for the admin endpoints.
+type EntryInfo struct {
+	Key               string      `json:"key"`
+	StatusCode        int         `json:"status"`
+	RequestHeader     http.Header `json:"request_header"`
+	ResponseHeader    http.Header `json:"response_header"`
+	Size              int         `json:"size"`
+	StoredAt          time.Time   `json:"stored_at"`
+	InvalidatedAt     *time.Time  `json:"invalidated_at,omitempty"`
+	Age               int         `json:"age"`
+	FreshnessLifetime int         `json:"freshness_lifetime"`
+	TTL               int         `json:"ttl"`
+	Fresh             bool        `json:"fresh"`
+	Hits              int64       `json:"hits"`
+}
+
+// ListEntries returns up to limit keys starting with prefix, in order,
+// after the key after.
+func (cs *CacheServer) ListEntries(prefix, after string, limit int) (keys []string, more bool) {
+	cache.RangeKeys(cs.cacheStore, func(key string) bool {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	slices.Sort(keys)
+	if len(keys) > limit {
+		return keys[:limit], true
+	}
+	return keys, false
+}
+
+// Inspect describes the entry stored under key.
+func (cs *CacheServer) Inspect(key string) (*EntryInfo, bool) {
+	cachedResp, ok := cs.cacheStore.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return cs.entryInfo(key, cachedResp), true
+}
+
+func (cs *CacheServer) entryInfo(key string, cachedResp *cache.CachedResponse) *EntryInfo {
+	header := cache.NewParsedHeaders(cachedResp.ResponseHeader)
+	info := &EntryInfo{
+		Key:               key,
+		StatusCode:        cachedResp.StatusCode,
+		RequestHeader:     cachedResp.RequestHeader,
+		ResponseHeader:    cachedResp.ResponseHeader,
+		Size:              len(cachedResp.Body),
+		StoredAt:          cachedResp.StoredAt,
+		Age:               cache.GetCurrentAge(cachedResp),
+		FreshnessLifetime: int(cache.GetFreshnessLifetimeForStatus(header, cachedResp.StatusCode).Seconds()),
+		TTL:               remainingTTL(cachedResp),
+		Fresh:             cache.IsFresh(cachedResp),
+		Hits:              cs.indexed.hitCount(key),
+	}
+	if !cachedResp.InvalidatedAt.IsZero() {
+		info.InvalidatedAt = &cachedResp.InvalidatedAt
+	}
+	return info
+}
+
+// handleEntries lists stored keys. prefix filters them, limit sets the page
+// size and after continues from the next value of the previous page.
+func (cs *CacheServer) handleEntries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	limit := defaultEntryListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxEntryListLimit)
+	}
+
+	keys, more := cs.ListEntries(query.Get("prefix"), query.Get("after"), limit)
+	list := entryList{Keys: keys}
+	if list.Keys == nil {
+		list.Keys = []string{}
+	}
+	if more {
+		list.Next = keys[len(keys)-1]
+	}
+	writeJSON(w, list)
+}
+
+// handleEntry describes the entry under the key query parameter, or the
+// one a request for url would currently use. With body=true it returns the
+// stored body instead, as a download.
+func (cs *CacheServer) handleEntry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	key := query.Get("key")
+	if key == "" && query.Has("url") {
+		target, err := url.Parse(query.Get("url"))
+		if err != nil {
+			http.Error(w, "invalid url", http.StatusBadRequest)
+			return
+		}
+		key = cs.cacheKey(target.String(), target.Host, cache.NewParsedHeaders(http.Header{}))
+	}
+	if key == "" {
+		http.Error(w, "key or url is required", http.StatusBadRequest)
+		return
+	}
+
+	cachedResp, ok := cs.cacheStore.Get(key)
+	if !ok {
+		http.Error(w, "Entry not found", http.StatusNotFound)
+		return
+	}
+	if body, _ := strconv.ParseBool(query.Get("body")); body {
+		// The body comes from the origin, so it must not be rendered as
+		// part of the admin interface.
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Disposition", "attachment")
+		if ce := cachedResp.ResponseHeader.Get("Content-Encoding"); ce != "" {
+			w.Header().Set("Content-Encoding", ce)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(cachedResp.Body)))
+		w.Write(cachedResp.Body)
+		return
+	}
+	writeJSON(w, cs.entryInfo(key, cachedResp))
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
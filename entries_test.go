@@ -0,0 +1,84 @@
+package kyache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestEntriesEndpointPages(t *testing.T) {
+	originURL, _ := url.Parse("http://example.com")
+	cs := New(&Config{EnableAdmin: true})
+	storeTestEntries(cs, "http://example.com/c", "http://example.com/a", "http://example.com/b", "http://other.example/a")
+	handler := cs.Handler(originURL)
+
+	var pages [][]string
+	after := ""
+	for {
+		w := httptest.NewRecorder()
+		target := "/admin/entries?limit=2&prefix=" + url.QueryEscape("http://example.com/") + "&after=" + url.QueryEscape(after)
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		var list entryList
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("decoding %q: %v", w.Body.String(), err)
+		}
+		pages = append(pages, list.Keys)
+		if list.Next == "" {
+			break
+		}
+		after = list.Next
+	}
+
+	want := [][]string{
+		{"http://example.com/a", "http://example.com/b"},
+		{"http://example.com/c"},
+	}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("pages = %q, want %q", pages, want)
+	}
+}
+
+func TestEntryEndpointDescribesEntry(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=600")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("cached body"))
+	})
+	cs := New(&Config{EnableAdmin: true})
+	handler := cs.Handler(originURL)
+	for range 3 {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page", nil))
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/entry?url="+url.QueryEscape(originURL.String()+"/page"), nil))
+	var info EntryInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body.String(), err)
+	}
+	if info.Key != originURL.String()+"/page" || info.Size != len("cached body") || info.Hits != 2 {
+		t.Errorf("entry = %+v", info)
+	}
+	if info.FreshnessLifetime != 600 || !info.Fresh || info.TTL <= 0 || info.TTL > 600 {
+		t.Errorf("freshness = lifetime %d, ttl %d, fresh %v", info.FreshnessLifetime, info.TTL, info.Fresh)
+	}
+	if info.ResponseHeader.Get("Content-Type") != "text/plain" {
+		t.Errorf("response header = %v", info.ResponseHeader)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/entry?body=true&key="+url.QueryEscape(info.Key), nil))
+	if w.Body.String() != "cached body" || w.Header().Get("Content-Type") != "application/octet-stream" ||
+		w.Header().Get("X-Content-Type-Options") != "nosniff" || w.Header().Get("Content-Disposition") != "attachment" {
+		t.Errorf("raw body = %q %v", w.Body.String(), w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/entry?key=missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("missing entry = %d, want 404", w.Code)
+	}
+}
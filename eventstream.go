@@ -0,0 +1,187 @@
+package kyache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// eventPurge is a purge in the event stream. Hard purges are evictions with
+// reason evictPurge everywhere else.
+const eventPurge = "purge"
+
+// Reasons of purge events.
+const (
+	purgeHard = "hard"
+	purgeSoft = "soft"
+)
+
+// streamBuffer is how many events a subscriber may fall behind by before
+// events are dropped for it.
+const streamBuffer = 1024
+
+// streamEvent is one line of the /admin/events stream. Its keys match the
+// attributes of kyache's log records.
+type streamEvent struct {
+	Time          time.Time `json:"time"`
+	Decision      string    `json:"decision"`
+	Key           string    `json:"key"`
+	Origin        string    `json:"origin"`
+	Path          string    `json:"path"`
+	Reason        string    `json:"reason,omitempty"`
+	Status        int       `json:"status,omitempty"`
+	Duration      float64   `json:"duration,omitempty"`
+	OriginLatency float64   `json:"origin_latency,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	// Dropped is set on "dropped" events, which tell a subscriber how many
+	// events it missed by reading too slowly.
+	Dropped int64 `json:"dropped,omitempty"`
+
+	hostname string
+}
+
+// eventStream fans cache events out to the subscribers of /admin/events.
+// Publishing never blocks: a subscriber that falls behind misses events.
+type eventStream struct {
+	n    atomic.Int32
+	mu   sync.Mutex
+	subs map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	host    string
+	prefix  string
+	events  chan streamEvent
+	dropped atomic.Int64
+}
+
+func newEventStream() *eventStream {
+	return &eventStream{subs: make(map[*subscriber]struct{})}
+}
+
+func (es *eventStream) subscribe(host, prefix string) *subscriber {
+	sub := &subscriber{host: strings.ToLower(host), prefix: prefix, events: make(chan streamEvent, streamBuffer)}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.subs[sub] = struct{}{}
+	es.n.Add(1)
+	return sub
+}
+
+func (es *eventStream) unsubscribe(sub *subscriber) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	delete(es.subs, sub)
+	es.n.Add(-1)
+}
+
+// publish sends an event of kind to every subscriber whose filter matches
+// it. It costs nothing while nobody is subscribed.
+func (es *eventStream) publish(kind string, e Event) {
+	if es.n.Load() == 0 {
+		return
+	}
+	se := streamEvent{
+		Time:          time.Now(),
+		Decision:      kind,
+		Key:           e.Key,
+		Reason:        e.Reason,
+		Status:        e.Status,
+		Duration:      e.Elapsed.Seconds(),
+		OriginLatency: e.OriginLatency.Seconds(),
+	}
+	if kind == eventEvict && e.Reason == evictPurge {
+		se.Decision, se.Reason = eventPurge, purgeHard
+	}
+	if u, err := url.Parse(e.Key); err == nil {
+		se.Origin, se.hostname, se.Path = strings.ToLower(u.Host), strings.ToLower(u.Hostname()), u.Path
+	}
+	if e.Err != nil {
+		se.Error = e.Err.Error()
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	for sub := range es.subs {
+		if !sub.matches(se) {
+			continue
+		}
+		select {
+		case sub.events <- se:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// matches reports whether se passes the subscriber's filters. A host
+// without a port matches every port.
+func (sub *subscriber) matches(se streamEvent) bool {
+	if sub.host != "" && se.Origin != sub.host && se.hostname != sub.host {
+		return false
+	}
+	return strings.HasPrefix(se.Path, sub.prefix)
+}
+
+// handleEvents streams cache events until the client goes away, as
+// Server-Sent Events if the client accepts them and as JSON lines
+// otherwise. The host and prefix query parameters filter events by origin
+// host and by path prefix.
+func (cs *CacheServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	sse := query.Get("format") == "sse" ||
+		query.Get("format") == "" && strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+	sub := cs.events.subscribe(query.Get("host"), query.Get("prefix"))
+	defer cs.events.unsubscribe(sub)
+
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case se := <-sub.events:
+			if n := sub.dropped.Swap(0); n > 0 {
+				if writeStreamEvent(w, sse, streamEvent{Time: time.Now(), Decision: "dropped", Dropped: n}) != nil {
+					return
+				}
+			}
+			if writeStreamEvent(w, sse, se) != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+func writeStreamEvent(w http.ResponseWriter, sse bool, se streamEvent) error {
+	line, err := json.Marshal(se)
+	if err != nil {
+		return err
+	}
+	if sse {
+		_, err = w.Write([]byte("event: " + se.Decision + "\ndata: " + string(line) + "\n\n"))
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,102 @@
+package kyache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// subscribeEvents opens /admin/events on server and returns a function that
+// reads the next event as "decision reason path".
+func subscribeEvents(t *testing.T, server *httptest.Server, query string) (func() string, *http.Response) {
+	t.Helper()
+	resp, err := http.Get(server.URL + "/admin/events?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	lines := bufio.NewScanner(resp.Body)
+	return func() string {
+		t.Helper()
+		if !lines.Scan() {
+			t.Fatalf("event stream ended: %v", lines.Err())
+		}
+		line := lines.Text()
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			line = data
+		} else if strings.HasPrefix(line, "event: ") || line == "" {
+			return ""
+		}
+		var se streamEvent
+		if err := json.Unmarshal([]byte(line), &se); err != nil {
+			t.Fatalf("decoding %q: %v", line, err)
+		}
+		return fmt.Sprintf("%s %s %s", se.Decision, se.Reason, se.Path)
+	}, resp
+}
+
+func TestEventStreamFiltersByPathPrefix(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	})
+	cs := New(&Config{EnableAdmin: true})
+	server := httptest.NewServer(cs.Handler(originURL))
+	t.Cleanup(server.Close)
+
+	next, resp := subscribeEvents(t, server, "host="+originURL.Hostname()+"&prefix=/news/")
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	for _, path := range []string{"/other", "/news/a", "/news/a"} {
+		r, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+	}
+	cs.SoftPurge(originURL.String() + "/news/a")
+	cs.Purge(originURL.String() + "/news/a")
+
+	want := []string{"miss uri-miss /news/a", "store fill /news/a", "hit fresh /news/a", "purge soft /news/a", "purge hard /news/a"}
+	for _, w := range want {
+		if got := next(); got != w {
+			t.Errorf("event = %q, want %q", got, w)
+		}
+	}
+}
+
+func TestEventStreamSSE(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("body"))
+	})
+	cs := New(&Config{EnableAdmin: true})
+	server := httptest.NewServer(cs.Handler(originURL))
+	t.Cleanup(server.Close)
+
+	next, resp := subscribeEvents(t, server, "format=sse&host=other.example")
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	r, err := http.Get(server.URL + "/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if cs.events.n.Load() != 1 {
+		t.Fatalf("%d subscribers, want 1", cs.events.n.Load())
+	}
+
+	// Only events for the subscribed host get through.
+	cs.events.publish(eventMiss, Event{Key: "http://other.example:8080/x", Reason: fwdURIMiss})
+	if got := next(); got != "" {
+		t.Errorf("first line = %q, want the event name", got)
+	}
+	if got := next(); got != "miss uri-miss /x" {
+		t.Errorf("event = %q", got)
+	}
+}
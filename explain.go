@@ -0,0 +1,106 @@
+package kyache
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+// explainHeader carries the Explanation of a request when
+// Config.ExplainHeader is set.
+const explainHeader = "Kyache-Explain"
+
+// Decisions of an Explanation.
+const (
+	decisionHit        = "hit"
+	decisionStale      = "stale"
+	decisionRevalidate = "revalidate"
+	decisionMiss       = "miss"
+	decisionBypass     = "bypass"
+)
+
+// Explanation is what the cache would do with a request, and why.
+type Explanation struct {
+	Key string `json:"key"`
+	// Decision is "hit"; "stale" when a stale entry would be served while
+	// it is revalidated in the background; "revalidate" when a stale entry
+	// would be revalidated with the origin first; "miss"; or "bypass" for
+	// requests that never use the cache.
+	Decision string `json:"decision"`
+	// Reasons are the checks behind Decision, such as "Vary mismatch on
+	// Accept-Language" or "freshness 1m from max-age, stale by 12s".
+	Reasons []string `json:"reasons"`
+}
+
+func (e Explanation) String() string {
+	return strings.Join(append([]string{e.Decision}, e.Reasons...), "; ")
+}
+
+// Explain reports what the cache would do with req without going to the
+// origin or counting the lookup. req.URL must be absolute, as for
+// RoundTrip.
+func (cs *CacheServer) Explain(req *http.Request) Explanation {
+	reqHeader := cache.NewParsedHeaders(req.Header)
+	key := req.URL.String()
+	if req.Method == http.MethodGet {
+		key = cs.cacheKey(key, req.URL.Host, reqHeader)
+	}
+	return cs.explain(key, req.Method, reqHeader)
+}
+
+func (cs *CacheServer) explain(key, method string, reqHeader *cache.ParsedHeaders) Explanation {
+	e := Explanation{Key: key}
+	if method != http.MethodGet {
+		e.Decision = decisionBypass
+		e.Reasons = []string{"method " + method}
+		return e
+	}
+	cachedResp, exists := cache.Peek(cs.cacheStore, key)
+	if !exists {
+		e.Decision = decisionMiss
+		e.Reasons = []string{"not in cache"}
+		return e
+	}
+	if cs.bans.banned(key, cachedResp) {
+		e.Decision = decisionMiss
+		e.Reasons = []string{"banned"}
+		return e
+	}
+	originalReqHeader := cache.NewParsedHeaders(cachedResp.RequestHeader)
+	respHeader := cache.NewParsedHeaders(cachedResp.ResponseHeader)
+	if ok, why := cache.ExplainReqAllowedToUseCache(reqHeader, originalReqHeader, respHeader); !ok {
+		e.Decision = decisionMiss
+		e.Reasons = []string{why}
+		return e
+	}
+
+	freshness := cache.ExplainFreshness(cachedResp)
+	e.Reasons = []string{freshness.String()}
+	switch {
+	case freshness.Fresh:
+		e.Decision = decisionHit
+	case cache.StaleWhileRevalidate(cachedResp):
+		e.Decision = decisionStale
+		e.Reasons = append(e.Reasons, "within stale-while-revalidate")
+	default:
+		e.Decision = decisionRevalidate
+		if cache.StaleIfError(cachedResp) {
+			e.Reasons = append(e.Reasons, "stale-if-error allows serving it if the origin fails")
+		}
+	}
+	return e
+}
+
+// explainStore adds to the explain header of w whether a response fetched
+// from the origin may be stored.
+func (cs *CacheServer) explainStore(w http.ResponseWriter, cacheable bool, why string) {
+	if !cs.explainResponses {
+		return
+	}
+	if cacheable {
+		w.Header().Add(explainHeader, "cacheable")
+		return
+	}
+	w.Header().Add(explainHeader, "not cacheable: "+why)
+}
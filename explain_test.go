@@ -0,0 +1,77 @@
+package kyache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestExplainDoesNotTouchOrigin(t *testing.T) {
+	fetches := 0
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("body"))
+	})
+	cs := New(&Config{})
+	target := originURL.String() + "/obj"
+	explain := func(lang string) Explanation {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("Accept-Language", lang)
+		return cs.Explain(req)
+	}
+
+	if e := explain("en"); e.Decision != "miss" || !reflect.DeepEqual(e.Reasons, []string{"not in cache"}) {
+		t.Errorf("before fill: %+v", e)
+	}
+	req := httptest.NewRequest("GET", "/obj", nil)
+	req.Header.Set("Accept-Language", "en")
+	cs.Handler(originURL).ServeHTTP(httptest.NewRecorder(), req)
+
+	if e := explain("en"); e.Key != target || e.Decision != "hit" || !reflect.DeepEqual(e.Reasons, []string{"freshness 1m from max-age, fresh for 1m"}) {
+		t.Errorf("after fill: %+v", e)
+	}
+	if e := explain("ja"); e.Decision != "miss" || !reflect.DeepEqual(e.Reasons, []string{"Vary mismatch on Accept-Language"}) {
+		t.Errorf("other language: %+v", e)
+	}
+	if fetches != 1 {
+		t.Errorf("origin fetched %d times, want 1", fetches)
+	}
+	if stats := cs.Stats(); stats.Hits != 0 || stats.Misses != 1 {
+		t.Errorf("Explain was counted: %+v", stats)
+	}
+}
+
+func TestExplainHeader(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "private")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte("body"))
+	})
+	tests := []struct {
+		explain bool
+		path    string
+		want    []string
+	}{
+		{false, "/obj", nil},
+		{true, "/obj", []string{"miss; not in cache", "cacheable"}},
+		{true, "/obj", []string{"hit; freshness 1m from max-age, fresh for 1m"}},
+		{true, "/private", []string{"miss; not in cache", "not cacheable: private in Cache-Control"}},
+	}
+	handlers := map[bool]http.Handler{
+		false: New(&Config{}).Handler(originURL),
+		true:  New(&Config{ExplainHeader: true}).Handler(originURL),
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handlers[tt.explain].ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if got := rec.Header().Values("Kyache-Explain"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GET %s with ExplainHeader %v: Kyache-Explain = %q, want %q", tt.path, tt.explain, got, tt.want)
+		}
+	}
+}
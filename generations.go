@@ -0,0 +1,125 @@
+package kyache
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+// generations tracks the cache generation of each host. Keys carry the
+// generation they were stored under, so bumping one makes every older entry
+// unreachable without touching the store. Global and per-host bumps draw
+// from one counter, and a host uses the larger of the global generation and
+// its own, so either kind of bump moves a host to a value it never had.
+type generations struct {
+	mu     sync.Mutex
+	last   uint64
+	global uint64
+	hosts  map[string]uint64
+}
+
+func newGenerations() *generations {
+	return &generations{hosts: make(map[string]uint64)}
+}
+
+func (g *generations) current(host string) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.currentLocked(strings.ToLower(host))
+}
+
+func (g *generations) currentLocked(host string) uint64 {
+	return max(g.global, g.hosts[host])
+}
+
+// bump starts a new generation for host, or for every host if host is
+// empty, and returns it.
+func (g *generations) bump(host string) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.last++
+	if host == "" {
+		g.global = g.last
+		// Hosts bumped on their own are all behind the global generation
+		// now.
+		clear(g.hosts)
+	} else {
+		g.hosts[strings.ToLower(host)] = g.last
+	}
+	return g.last
+}
+
+// recover picks up the generations in use by the keys of a store that
+// outlived the process, such as a DiskStore. The newest generation seen for
+// a host becomes its current one.
+func (g *generations) recover(store cache.Store) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	cache.RangeKeys(store, func(key string) bool {
+		host, generation, ok := keyHost(key)
+		if ok && generation > g.hosts[host] {
+			g.hosts[host] = generation
+			g.last = max(g.last, generation)
+		}
+		return true
+	})
+}
+
+// outdated reports whether key belongs to an earlier generation.
+func (g *generations) outdated(key string) bool {
+	host, generation, ok := keyHost(key)
+	if !ok {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return generation < g.currentLocked(host)
+}
+
+func keyHost(key string) (string, uint64, bool) {
+	urlStr, generation := cache.KeyGeneration(key)
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return "", 0, false
+	}
+	return strings.ToLower(u.Host), generation, true
+}
+
+// BumpGeneration starts a new cache generation for every host. Entries
+// stored before it stop being served at once, and are deleted by a
+// background sweep. It returns the new generation.
+func (cs *CacheServer) BumpGeneration() uint64 {
+	generation := cs.generations.bump("")
+	cs.generationSweep.trigger()
+	return generation
+}
+
+// BumpHostGeneration is BumpGeneration for a single host, given as it
+// appears in URLs, with the port if it is not the default one.
+func (cs *CacheServer) BumpHostGeneration(host string) uint64 {
+	generation := cs.generations.bump(host)
+	cs.generationSweep.trigger()
+	return generation
+}
+
+// cacheKey returns the key for rawURL in the current generation of host.
+func (cs *CacheServer) cacheKey(rawURL, host string, header *cache.ParsedHeaders) string {
+	return cache.GenerateCacheKeyForGeneration(rawURL, header, cs.generations.current(host))
+}
+
+// sweepGenerations deletes the entries of earlier generations. It runs in
+// the background, started by the bumps.
+func (cs *CacheServer) sweepGenerations() {
+	var outdated []string
+	cache.RangeKeys(cs.cacheStore, func(key string) bool {
+		if cs.generations.outdated(key) {
+			outdated = append(outdated, key)
+		}
+		return true
+	})
+	for _, key := range outdated {
+		cs.evict(key, evictGeneration)
+	}
+}
@@ -0,0 +1,122 @@
+package kyache
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+func TestKeyGeneration(t *testing.T) {
+	key := cache.GenerateCacheKeyForGeneration("http://example.com/a", nil, 7)
+	for _, k := range []string{key, sliceKey(key, `"v1"`, 2), sliceMetaKey(key)} {
+		urlStr, generation := cache.KeyGeneration(k)
+		if urlStr != "http://example.com/a" || generation != 7 {
+			t.Errorf("KeyGeneration(%q) = %q, %d", k, urlStr, generation)
+		}
+	}
+	if _, generation := cache.KeyGeneration(sliceMetaKey("http://example.com/a")); generation != 0 {
+		t.Errorf("generation of an unversioned key = %d, want 0", generation)
+	}
+	if key := cache.GenerateCacheKey("http://example.com/a", nil); key != "http://example.com/a" {
+		t.Errorf("GenerateCacheKey() = %q, want the URL unchanged", key)
+	}
+}
+
+func TestBumpGenerationHidesAndSweepsEntries(t *testing.T) {
+	var fetches atomic.Int32
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "max-age=600")
+		w.Write([]byte("body"))
+	})
+	cs := New(&Config{})
+	handler := cs.Handler(originURL)
+	get := func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page", nil))
+	}
+
+	get()
+	get()
+	if fetches.Load() != 1 {
+		t.Fatalf("origin fetched %d times before the bump, want 1", fetches.Load())
+	}
+
+	cs.BumpHostGeneration(originURL.Host)
+	get()
+	if fetches.Load() != 2 {
+		t.Errorf("origin fetched %d times after the bump, want 2", fetches.Load())
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := cs.cacheStore.Get(originURL.String() + "/page"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("outdated entry was not swept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGlobalAndHostGenerations(t *testing.T) {
+	g := newGenerations()
+	a := g.bump("a.example")
+	if g.current("a.example") != a || g.current("b.example") != 0 {
+		t.Fatalf("host bump leaked to other hosts")
+	}
+	global := g.bump("")
+	if g.current("a.example") != global || g.current("b.example") != global {
+		t.Errorf("global bump did not reach every host")
+	}
+	if !g.outdated(cache.GenerateCacheKeyForGeneration("http://a.example/", nil, a)) {
+		t.Errorf("key from before the global bump is not outdated")
+	}
+}
+
+func TestGenerationsRecoverFromStore(t *testing.T) {
+	store := cache.NewCacheStore()
+	store.Set(cache.GenerateCacheKeyForGeneration("http://a.example/x", nil, 4), &cache.CachedResponse{})
+	cs := New(&Config{Store: store})
+	if got := cs.generations.current("a.example"); got != 4 {
+		t.Errorf("recovered generation = %d, want 4", got)
+	}
+	if next := cs.BumpGeneration(); next <= 4 {
+		t.Errorf("generation after recovery = %d, want more than 4", next)
+	}
+}
+
+func TestSnapshotCarriesGenerations(t *testing.T) {
+	var fetches atomic.Int32
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "max-age=600")
+		w.Write([]byte("body"))
+	})
+	src := New(&Config{})
+	src.BumpHostGeneration(originURL.Host)
+	src.Handler(originURL).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page", nil))
+	// An outdated entry the sweep has not reached yet.
+	storeTestEntries(src, originURL.String()+"/old")
+
+	var snapshot bytes.Buffer
+	if n, err := src.Snapshot(&snapshot); err != nil || n != 1 {
+		t.Fatalf("Snapshot() = %d, %v, want only the current entry", n, err)
+	}
+
+	dst := New(&Config{})
+	if _, err := dst.Restore(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	dst.Handler(originURL).ServeHTTP(w, httptest.NewRequest("GET", "/page", nil))
+	if fetches.Load() != 1 || !strings.Contains(w.Header().Get("Cache-Status"), "hit") {
+		t.Errorf("restored entry not served: %d fetches, Cache-Status %q", fetches.Load(), w.Header().Get("Cache-Status"))
+	}
+}
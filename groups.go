@@ -0,0 +1,143 @@
+package kyache
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Cache groups (draft-ietf-httpbis-cache-groups) name sets of responses.
+// An origin lists the groups a response belongs to in Cache-Groups, and
+// lists groups in Cache-Group-Invalidation on the response to an unsafe
+// request to invalidate every stored response in them. Groups are scoped
+// to the origin, so one origin cannot invalidate another's responses.
+
+// groupLabel is the index label of group on origin. It contains a space,
+// which a surrogate key never does, so it cannot collide with a tag.
+func groupLabel(origin, group string) string {
+	return origin + " " + group
+}
+
+// originOf returns the scheme and host of u, normalized for comparison.
+func originOf(u *url.URL) string {
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host)
+}
+
+func groupLabels(key string, h http.Header) []string {
+	groups := parseStringList(h.Values("Cache-Groups"))
+	if len(groups) == 0 {
+		return nil
+	}
+	u, err := url.Parse(key)
+	if err != nil {
+		return nil
+	}
+	origin := originOf(u)
+	labels := make([]string, len(groups))
+	for i, group := range groups {
+		labels[i] = groupLabel(origin, group)
+	}
+	return labels
+}
+
+// parseStringList returns the string members of a structured field list
+// (RFC 8941), such as `"scripts", "styles"`. Parameters are skipped and
+// members that are not strings are ignored.
+func parseStringList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for i := 0; i < len(v); {
+			if v[i] == ' ' || v[i] == '\t' {
+				i++
+				continue
+			}
+			switch v[i] {
+			case '"':
+				s, n, ok := parseSFString(v[i:])
+				if !ok {
+					return out
+				}
+				out = append(out, s)
+				i += n
+			default:
+				// Skip to the next member.
+				next := strings.IndexByte(v[i:], ',')
+				if next < 0 {
+					i = len(v)
+				} else {
+					i += next + 1
+				}
+			}
+		}
+	}
+	return out
+}
+
+// parseSFString parses the quoted string at the start of v and returns it
+// with the number of bytes consumed, up to the next member.
+func parseSFString(v string) (string, int, bool) {
+	var b strings.Builder
+	i := 1
+	for ; i < len(v); i++ {
+		c := v[i]
+		if c == '\\' {
+			i++
+			if i == len(v) || (v[i] != '"' && v[i] != '\\') {
+				return "", 0, false
+			}
+			b.WriteByte(v[i])
+			continue
+		}
+		if c == '"' {
+			break
+		}
+		if c < 0x20 || c > 0x7e {
+			return "", 0, false
+		}
+		b.WriteByte(c)
+	}
+	if i == len(v) {
+		return "", 0, false
+	}
+	i++
+	// Skip parameters and whitespace up to the next member.
+	if next := strings.IndexByte(v[i:], ','); next >= 0 {
+		i += next + 1
+	} else {
+		i = len(v)
+	}
+	return b.String(), i, true
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// invalidateGroups processes Cache-Group-Invalidation on resp, the response
+// to req. Invalidated responses are marked stale, as a soft purge does.
+func (cs *CacheServer) invalidateGroups(req *http.Request, resp *http.Response) int {
+	if isSafeMethod(req.Method) || resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return 0
+	}
+	groups := parseStringList(resp.Header.Values("Cache-Group-Invalidation"))
+	if len(groups) == 0 {
+		return 0
+	}
+	cs.indexed.load()
+	origin := originOf(req.URL)
+	var keys []string
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		for _, key := range cs.indexed.index.lookup(groupLabel(origin, group)) {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	return cs.purgeKeys(keys, true)
+}
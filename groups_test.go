@@ -0,0 +1,79 @@
+package kyache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+func TestParseStringList(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want []string
+	}{
+		{[]string{`"scripts", "styles"`}, []string{"scripts", "styles"}},
+		{[]string{`"a";p=1, token, "b\"c"`}, []string{"a", `b"c`}},
+		{[]string{`"a, b"`, `"c"`}, []string{"a, b", "c"}},
+		{[]string{`"unterminated`}, nil},
+	}
+	for _, tt := range tests {
+		if got := parseStringList(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseStringList(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCacheGroupInvalidation(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.Header().Set("Cache-Group-Invalidation", `"products"`)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=600")
+		switch r.URL.Path {
+		case "/list", "/item":
+			w.Header().Set("Cache-Groups", `"products", "pages"`)
+		case "/about":
+			w.Header().Set("Cache-Groups", `"pages"`)
+		}
+		w.Write([]byte("body"))
+	})
+	cs := New(&Config{})
+	handler := cs.Handler(originURL)
+	for _, path := range []string{"/list", "/item", "/about"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/item", nil))
+
+	for path, wantStale := range map[string]bool{"/list": true, "/item": true, "/about": false} {
+		cached, ok := cs.cacheStore.Get(originURL.String() + path)
+		if !ok {
+			t.Fatalf("%s was removed", path)
+		}
+		if stale := !cached.InvalidatedAt.IsZero(); stale != wantStale {
+			t.Errorf("%s invalidated = %v, want %v", path, stale, wantStale)
+		}
+	}
+}
+
+func TestCacheGroupsAreScopedToOrigin(t *testing.T) {
+	cs := New(&Config{})
+	cs.cacheStore.Set("http://other.example/list", &cache.CachedResponse{
+		StatusCode:     http.StatusOK,
+		RequestHeader:  http.Header{},
+		ResponseHeader: http.Header{"Cache-Groups": []string{`"products"`}},
+	})
+
+	req := httptest.NewRequest("POST", "http://example.com/item", nil)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Cache-Group-Invalidation": []string{`"products"`}},
+	}
+	if n := cs.invalidateGroups(req, resp); n != 0 {
+		t.Errorf("invalidated %d entries of another origin", n)
+	}
+}
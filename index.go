@@ -0,0 +1,189 @@
+package kyache
+
+import (
+	"maps"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+// indexedStore keeps per-entry bookkeeping in step with the entries written
+// through it: a tagIndex of surrogate keys and cache groups, hit counts and
+// the space taken per origin host. Entries the store drops on its own are
+// forgotten when it reports their eviction, or else once a lookup or purge
+// finds them gone. Entries a ban newer than them matches are not stored.
+type indexedStore struct {
+	cache.Store
+	index  *tagIndex
+	usage  *hostUsage
+	bans   *banList
+	loaded sync.Once
+	hits   sync.Map // key -> *atomic.Int64
+}
+
+// Set records the entry before storing it, so a store that evicts it again
+// straight away leaves no trace of it.
+func (s *indexedStore) Set(key string, resp *cache.CachedResponse) {
+	if s.bans.refuses(key, resp) {
+		return
+	}
+	s.index.set(key, entryLabels(key, resp.ResponseHeader))
+	s.usage.set(key, cache.EntrySize(resp))
+	s.hits.Delete(key)
+	s.Store.Set(key, resp)
+}
+
+func (s *indexedStore) Delete(key string) bool {
+	s.forget(key)
+	return s.Store.Delete(key)
+}
+
+func (s *indexedStore) Peek(key string) (*cache.CachedResponse, bool) {
+	return cache.Peek(s.Store, key)
+}
+
+func (s *indexedStore) RangeKeys(fn func(key string) bool) {
+	cache.RangeKeys(s.Store, fn)
+}
+
+func (s *indexedStore) forget(key string) {
+	s.index.remove(key)
+	s.usage.remove(key)
+	s.hits.Delete(key)
+}
+
+// hit counts a fresh hit on the entry under key.
+func (s *indexedStore) hit(key string) {
+	counter, _ := s.hits.LoadOrStore(key, new(atomic.Int64))
+	counter.(*atomic.Int64).Add(1)
+}
+
+// hitCount returns the hits on the entry under key since it was stored.
+func (s *indexedStore) hitCount(key string) int64 {
+	if counter, ok := s.hits.Load(key); ok {
+		return counter.(*atomic.Int64).Load()
+	}
+	return 0
+}
+
+// load indexes entries that were already in the store, such as those of a
+// reopened disk store. It runs once, before the first index lookup, so
+// startup doesn't have to read every entry.
+func (s *indexedStore) load() {
+	s.loaded.Do(func() {
+		s.Store.Range(func(key string, resp *cache.CachedResponse) bool {
+			if labels := entryLabels(key, resp.ResponseHeader); len(labels) > 0 {
+				s.index.set(key, labels)
+			}
+			return true
+		})
+	})
+}
+
+// loadUsage records the sizes of entries that were already in the store,
+// such as those of a reopened disk store. Only stores that know their
+// entry sizes without reading the entries are asked; others are assumed to
+// start out empty.
+func (s *indexedStore) loadUsage() {
+	if sr, ok := s.Store.(cache.SizeRanger); ok {
+		sr.RangeSizes(func(key string, size int64) bool {
+			s.usage.setIfAbsent(key, size)
+			return true
+		})
+	}
+}
+
+// usageByHost returns the entries and bytes stored per origin host.
+func (s *indexedStore) usageByHost() map[string]hostTotals {
+	return s.usage.totals()
+}
+
+// hostUsage tracks the size of each entry and the totals per origin host.
+type hostUsage struct {
+	mu    sync.Mutex
+	sizes map[string]int64 // key -> size
+	hosts map[string]hostTotals
+}
+
+type hostTotals struct {
+	entries int
+	bytes   int64
+}
+
+func newHostUsage() *hostUsage {
+	return &hostUsage{sizes: make(map[string]int64), hosts: make(map[string]hostTotals)}
+}
+
+func (u *hostUsage) set(key string, size int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.removeLocked(key)
+	u.addLocked(key, size)
+}
+
+// setIfAbsent records key unless it is known already, so loading existing
+// entries does not undo newer writes.
+func (u *hostUsage) setIfAbsent(key string, size int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.sizes[key]; !ok {
+		u.addLocked(key, size)
+	}
+}
+
+func (u *hostUsage) remove(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.removeLocked(key)
+}
+
+func (u *hostUsage) addLocked(key string, size int64) {
+	host := entryHost(key)
+	t := u.hosts[host]
+	t.entries++
+	t.bytes += size
+	u.hosts[host] = t
+	u.sizes[key] = size
+}
+
+func (u *hostUsage) removeLocked(key string) {
+	size, ok := u.sizes[key]
+	if !ok {
+		return
+	}
+	delete(u.sizes, key)
+	host := entryHost(key)
+	t := u.hosts[host]
+	t.entries--
+	t.bytes -= size
+	if t.entries == 0 {
+		delete(u.hosts, host)
+	} else {
+		u.hosts[host] = t
+	}
+}
+
+func (u *hostUsage) totals() map[string]hostTotals {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return maps.Clone(u.hosts)
+}
+
+// entryHost returns the origin host of a cache key, as keyHost does. It
+// runs on every request, so it slices the key instead of parsing it.
+func entryHost(key string) string {
+	urlStr, _ := cache.KeyGeneration(key)
+	_, authority, ok := strings.Cut(urlStr, "://")
+	if !ok {
+		return ""
+	}
+	if i := strings.IndexAny(authority, "/?#"); i >= 0 {
+		authority = authority[:i]
+	}
+	if i := strings.LastIndexByte(authority, '@'); i >= 0 {
+		authority = authority[i+1:]
+	}
+	return strings.ToLower(authority)
+}
@@ -2,9 +2,10 @@ package kyache
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -15,15 +16,98 @@ import (
 )
 
 type CacheServer struct {
-	cacheStore   *cache.CacheStore
-	transport    http.RoundTripper
-	pathHandlers map[string]http.HandlerFunc
+	cacheStore    cache.Store
+	transport     http.RoundTripper
+	pathHandlers  map[string]http.HandlerFunc
+	maxObjectSize int64
+
+	fills           *fillGroup
+	collapseTimeout time.Duration
+	sliceSize       int64
+	unsliceable     *unsliceable
+
+	backgroundFills       chan struct{}
+	backgroundFillTimeout time.Duration
+
+	adminEnabled bool
+
+	indexed         *indexedStore
+	stripTagHeaders bool
+
+	generations     *generations
+	generationSweep *sweeper
+
+	bans     *banList
+	banSweep *sweeper
+
+	observer   Observer
+	events     *eventStream
+	logger     *slog.Logger
+	debugHosts map[string]bool
+	accessLog  *AccessLog
+
+	explainResponses bool
+	spanExporter     SpanExporter
+
+	stats     cacheStats
+	metrics   *metrics
+	startedAt time.Time
 }
 
 type Config struct {
 	Transport   http.RoundTripper
 	EnableHTTP3 bool
 	TLSConfig   *tls.Config
+	// Store holds cached responses. Defaults to an in-memory cache.CacheStore;
+	// use cache.NewDiskStore to keep entries across restarts.
+	Store cache.Store
+	// EnableAdmin registers the /admin/ endpoints and accepts PURGE requests.
+	// They are unauthenticated, so only enable them where the listener is
+	// not publicly reachable.
+	EnableAdmin bool
+	// EnableMetrics serves Prometheus metrics on /metrics. They name every
+	// origin host, so keep them off public listeners as well.
+	EnableMetrics bool
+	// MaxObjectSize is the largest body kyache buffers for the cache. Larger
+	// responses are streamed through without being stored. Zero uses
+	// DefaultMaxObjectSize and a negative value removes the limit.
+	MaxObjectSize int64
+	// CollapseTimeout bounds how long a cache miss waits for a concurrent
+	// origin fetch of the same key before fetching on its own. Zero uses
+	// DefaultCollapseTimeout and a negative value disables collapsing.
+	CollapseTimeout time.Duration
+	// SliceSize enables slicing when positive: the Handler fetches and
+	// caches origin objects in Range slices of this many bytes, so large
+	// objects are never fetched or held in one piece.
+	SliceSize int64
+	// MaxBackgroundFills enables finishing cache fills after the client has
+	// disconnected, with at most this many running at once. Zero disables it.
+	MaxBackgroundFills int
+	// BackgroundFillTimeout bounds how long a fill may run once its client
+	// is gone. Zero uses DefaultBackgroundFillTimeout.
+	BackgroundFillTimeout time.Duration
+	// StripTagHeaders removes the Surrogate-Key and Cache-Tag headers from
+	// responses before they reach clients. Stored entries keep them.
+	StripTagHeaders bool
+	// Observer is told about every hit, miss, store, eviction, revalidation
+	// and origin error. Its methods are called synchronously.
+	Observer Observer
+	// Logger receives origin errors, and cache decisions at debug level.
+	// Defaults to slog.Default().
+	Logger *slog.Logger
+	// DebugHosts lists origin hosts whose cache decisions are logged even
+	// when the logger's handler is set above debug level.
+	DebugHosts []string
+	// AccessLog, if set, gets a line for every request the Handler serves.
+	AccessLog *AccessLog
+	// ExplainHeader adds a Kyache-Explain header to the Handler's responses
+	// saying why the cache served or forwarded the request, and whether the
+	// origin's response could be stored. Meant for debugging.
+	ExplainHeader bool
+	// SpanExporter enables tracing: requests get spans for the cache lookup,
+	// origin fetch and storage, and origin requests carry the trace in their
+	// traceparent header.
+	SpanExporter SpanExporter
 }
 
 func New(config *Config) *CacheServer {
@@ -44,49 +128,258 @@ func New(config *Config) *CacheServer {
 		}
 	}
 
+	store := config.Store
+	if store == nil {
+		store = cache.NewCacheStore()
+	}
+
+	maxObjectSize := config.MaxObjectSize
+	if maxObjectSize == 0 {
+		maxObjectSize = DefaultMaxObjectSize
+	}
+
+	collapseTimeout := config.CollapseTimeout
+	if collapseTimeout == 0 {
+		collapseTimeout = DefaultCollapseTimeout
+	}
+
+	bans := &banList{}
+	indexed := &indexedStore{Store: store, index: newTagIndex(), usage: newHostUsage(), bans: bans}
+	indexed.loadUsage()
+
 	cs := &CacheServer{
-		cacheStore:   cache.NewCacheStore(),
-		transport:    transport,
-		pathHandlers: make(map[string]http.HandlerFunc),
+		cacheStore:       indexed,
+		transport:        transport,
+		pathHandlers:     make(map[string]http.HandlerFunc),
+		maxObjectSize:    maxObjectSize,
+		fills:            newFillGroup(),
+		collapseTimeout:  collapseTimeout,
+		sliceSize:        config.SliceSize,
+		unsliceable:      newUnsliceable(),
+		adminEnabled:     config.EnableAdmin,
+		indexed:          indexed,
+		stripTagHeaders:  config.StripTagHeaders,
+		generations:      newGenerations(),
+		bans:             bans,
+		metrics:          newMetrics(),
+		observer:         NopObserver{},
+		events:           newEventStream(),
+		logger:           config.Logger,
+		debugHosts:       newDebugHosts(config.DebugHosts),
+		accessLog:        config.AccessLog,
+		explainResponses: config.ExplainHeader,
+		spanExporter:     config.SpanExporter,
+		startedAt:        time.Now(),
+	}
+	cs.generations.recover(store)
+	cs.generationSweep = newSweeper(cs.sweepGenerations)
+	cs.banSweep = newSweeper(cs.sweepBans)
+	if config.Observer != nil {
+		cs.observer = config.Observer
+	}
+	if cs.logger == nil {
+		cs.logger = slog.Default()
+	}
+	if cs.accessLog != nil {
+		cs.accessLog.setLogger(cs.logger)
+	}
+	if notifier, ok := store.(cache.EvictionNotifier); ok {
+		notifier.NotifyEvict(cs.evicted)
+	}
+
+	if config.MaxBackgroundFills > 0 {
+		cs.backgroundFills = make(chan struct{}, config.MaxBackgroundFills)
+		cs.backgroundFillTimeout = config.BackgroundFillTimeout
+		if cs.backgroundFillTimeout == 0 {
+			cs.backgroundFillTimeout = DefaultBackgroundFillTimeout
+		}
 	}
 
 	cs.RegisterPath("/statusz", cs.handleStatus)
+	if config.EnableMetrics {
+		cs.RegisterPath("/metrics", cs.handleMetrics)
+	}
+	if config.EnableAdmin {
+		cs.registerAdminPaths()
+	}
 	return cs
 }
 
 func (cs *CacheServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, rs := cs.startRequestSpan(withExchange(req.Context()), req)
+	defer rs.endRequest(exchangeFrom(ctx))
+	req = req.WithContext(ctx)
 	if req.Method != http.MethodGet {
-		return cs.transport.RoundTrip(req)
+		resp, err := cs.roundTrip(req)
+		if err != nil {
+			cs.countError(ctx, req.URL.String(), reasonOrigin, err)
+			cs.countMiss(ctx, req.URL.String(), fwdMethod, 0)
+			return nil, err
+		}
+		cs.invalidateGroups(req, resp)
+		cs.countMiss(ctx, req.URL.String(), fwdMethod, resp.StatusCode)
+		return resp, nil
 	}
 
 	reqHeaderStruct := cache.NewParsedHeaders(req.Header)
-	key := cache.GenerateCacheKey(req.URL.String(), reqHeaderStruct)
+	key := cs.cacheKey(req.URL.String(), req.URL.Host, reqHeaderStruct)
 
-	if cachedResp, exists := cs.cacheStore.Get(key); exists {
-		respHeader := cache.NewParsedHeaders(cachedResp.ResponseHeader)
-		originalReqHeaderStruct := cache.NewParsedHeaders(cachedResp.RequestHeader)
-		if cache.IsFresh(cachedResp) && cache.IsReqAllowedToUseCache(reqHeaderStruct, originalReqHeaderStruct, respHeader) {
-			return cs.createResponseFromCache(cachedResp, req), nil
+	cachedResp, fwd := cs.lookup(ctx, key, reqHeaderStruct)
+	if fwd == "" {
+		cs.countHit(ctx, key, reasonFresh, cachedResp, int64(len(cachedResp.Body)))
+		return cs.createResponseFromCache(cachedResp, req, cacheStatusHit(cachedResp)), nil
+	}
+	var stale *cache.CachedResponse
+	if fwd == fwdStale {
+		stale = cachedResp
+		if cache.StaleWhileRevalidate(stale) {
+			cs.revalidateInBackground(req.Clone(ctx), key, stale)
+			cs.countStale(ctx, key, reasonStaleWhileRevalidate, stale)
+			return cs.createResponseFromCache(stale, req, cacheStatusRevalidating(stale)), nil
 		}
 	}
 
-	resp, err := cs.transport.RoundTrip(req)
+	f, leader, res := cs.joinFill(ctx, key)
+	if !leader {
+		if partial := res.partial; partial != nil && cs.usable(partial.resp, reqHeaderStruct) == "" {
+			cs.countHit(ctx, key, reasonCollapsed, partial.resp, 0)
+			resp := cs.createPartialResponse(partial, req, cacheStatusCollapsed(fwd))
+			resp.Body = cs.stats.cacheBody(resp.Body)
+			return resp, nil
+		}
+		if res.stored {
+			if cachedResp, miss := cs.lookup(ctx, key, reqHeaderStruct); miss == "" {
+				cs.countHit(ctx, key, reasonCollapsed, cachedResp, int64(len(cachedResp.Body)))
+				return cs.createResponseFromCache(cachedResp, req, cacheStatusCollapsed(fwd)), nil
+			}
+		}
+	}
+
+	originReq := req
+	conditional := false
+	if stale != nil {
+		originReq = req.Clone(ctx)
+		conditional = addValidators(originReq.Header, stale)
+	}
+	resp, err := cs.roundTrip(originReq)
 	if err != nil {
+		cs.finishFill(key, f, false)
+		cs.countError(ctx, key, reasonOrigin, err)
+		if stale != nil && cache.StaleIfError(stale) {
+			cs.countStale(ctx, key, reasonStaleIfError, stale)
+			return cs.createResponseFromCache(stale, req, cacheStatusStaleIfError(0)), nil
+		}
+		cs.countMiss(ctx, key, fwd, 0)
 		return nil, err
 	}
+	if conditional {
+		cs.countRevalidation(ctx, key, stale, resp.StatusCode)
+	}
+	if stale != nil {
+		if resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			entry := refreshedEntry(stale, resp)
+			cs.store(ctx, key, reasonRefresh, entry)
+			cs.finishFill(key, f, true)
+			cs.countRevalidated(ctx, key, entry)
+			return cs.createResponseFromCache(entry, req, cacheStatusForward(fwd, resp.StatusCode)), nil
+		}
+		if isServerError(resp.StatusCode) && cache.StaleIfError(stale) {
+			resp.Body.Close()
+			cs.finishFill(key, f, false)
+			cs.countStale(ctx, key, reasonStaleIfError, stale)
+			return cs.createResponseFromCache(stale, req, cacheStatusStaleIfError(resp.StatusCode)), nil
+		}
+	}
 
 	respHeaderStruct := cache.NewParsedHeaders(resp.Header)
 
 	if cache.IsCacheable(resp.Request.Method, respHeaderStruct) {
-		cs.cacheResponseFromReader(key, req, resp, respHeaderStruct)
+		cs.teeResponseIntoCache(key, req, resp, respHeaderStruct, f)
+	} else {
+		cs.finishFill(key, f, false)
 	}
+	cs.removeHiddenHeaders(resp.Header)
+	addCacheStatus(resp.Header, cacheStatusForward(fwd, resp.StatusCode))
+	cs.countMiss(ctx, key, fwd, resp.StatusCode)
+	resp.Body = cs.stats.originBody(resp.Body)
 
 	return resp, nil
 }
 
-func (cs *CacheServer) createResponseFromCache(cachedResp *cache.CachedResponse, req *http.Request) *http.Response {
-	header := cachedResp.RequestHeader.Clone()
+// lookup returns the stored response for key and an empty fwd if it may be
+// used for a request with reqHeader. Otherwise fwd is the Cache-Status
+// reason for going to the origin, and for fwdStale the stale response is
+// returned so it can be revalidated.
+func (cs *CacheServer) lookup(ctx context.Context, key string, reqHeader *cache.ParsedHeaders) (*cache.CachedResponse, string) {
+	_, span := cs.startSpan(ctx, spanLookup)
+	span.set("cache.key", key)
+	cachedResp, fwd := cs.lookupEntry(key, reqHeader)
+	span.set("cache.fwd", fwd)
+	span.end()
+	return cachedResp, fwd
+}
+
+func (cs *CacheServer) lookupEntry(key string, reqHeader *cache.ParsedHeaders) (*cache.CachedResponse, string) {
+	cachedResp, exists := cs.cacheStore.Get(key)
+	if !exists {
+		cs.indexed.forget(key)
+		return nil, fwdURIMiss
+	}
+	if cs.bans.banned(key, cachedResp) {
+		cs.evict(key, evictBan)
+		return nil, fwdURIMiss
+	}
+	switch fwd := cs.usable(cachedResp, reqHeader); fwd {
+	case "":
+		cs.indexed.hit(key)
+		return cachedResp, ""
+	case fwdStale:
+		return cachedResp, fwd
+	default:
+		return nil, fwd
+	}
+}
+
+// usable returns an empty string if cachedResp can be served for a request
+// with reqHeader, or the fwd reason why it cannot.
+func (cs *CacheServer) usable(cachedResp *cache.CachedResponse, reqHeader *cache.ParsedHeaders) string {
+	originalReqHeaderStruct := cache.NewParsedHeaders(cachedResp.RequestHeader)
+	respHeader := cache.NewParsedHeaders(cachedResp.ResponseHeader)
+
+	if !cache.IsReqAllowedToUseCache(reqHeader, originalReqHeaderStruct, respHeader) {
+		return fwdMiss
+	}
+	if !cache.IsFresh(cachedResp) {
+		return fwdStale
+	}
+	return ""
+}
+
+func (cs *CacheServer) createResponseFromCache(cachedResp *cache.CachedResponse, req *http.Request, cacheStatus string) *http.Response {
+	resp := cs.createResponseHeader(cachedResp, req, cacheStatus)
+	resp.Body = io.NopCloser(bytes.NewReader(cachedResp.Body))
+	resp.ContentLength = int64(len(cachedResp.Body))
+	return resp
+}
+
+// createPartialResponse follows the body of a fill that is still in
+// progress.
+func (cs *CacheServer) createPartialResponse(partial *partialEntry, req *http.Request, cacheStatus string) *http.Response {
+	resp := cs.createResponseHeader(partial.resp, req, cacheStatus)
+	resp.Body = io.NopCloser(partial.body.NewReader())
+	resp.ContentLength = -1
+	if n, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		resp.ContentLength = n
+	}
+	return resp
+}
+
+func (cs *CacheServer) createResponseHeader(cachedResp *cache.CachedResponse, req *http.Request, cacheStatus string) *http.Response {
+	header := cachedResp.ResponseHeader.Clone()
+	cs.removeHiddenHeaders(header)
 	header.Set("Age", strconv.Itoa(cache.GetCurrentAge(cachedResp)))
+	addCacheStatus(header, cacheStatus)
 
 	// Use stored protocol information, fallback to HTTP/1.1 if not available
 	protoMajor, protoMinor, proto := cachedResp.ProtoMajor, cachedResp.ProtoMinor, cachedResp.Proto
@@ -95,111 +388,259 @@ func (cs *CacheServer) createResponseFromCache(cachedResp *cache.CachedResponse,
 	}
 
 	return &http.Response{
-		StatusCode:    cachedResp.StatusCode,
-		Header:        header,
-		Body:          io.NopCloser(bytes.NewReader(cachedResp.Body)),
-		ContentLength: int64(len(cachedResp.Body)),
-		Request:       req,
-		ProtoMajor:    protoMajor,
-		ProtoMinor:    protoMinor,
-		Proto:         proto,
+		StatusCode: cachedResp.StatusCode,
+		Header:     header,
+		Request:    req,
+		ProtoMajor: protoMajor,
+		ProtoMinor: protoMinor,
+		Proto:      proto,
 	}
 }
 
-func (cs *CacheServer) cacheResponseFromReader(key string, req *http.Request, resp *http.Response, header *cache.ParsedHeaders) {
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Failed to read response body for caching: %v", err)
-		return
+// teeResponseIntoCache replaces resp.Body so the body is stored once the
+// caller has read all of it, instead of buffering it before returning.
+// Requests collapsed into f follow the body as the caller reads it.
+func (cs *CacheServer) teeResponseIntoCache(key string, req *http.Request, resp *http.Response, header *cache.ParsedHeaders, f *fill) {
+	// Keep the origin's header as it was; the caller's copy gets our
+	// Cache-Status member.
+	entry := cs.newCachedResponse(req, resp, header)
+	fill := cs.newFillBuffer(resp)
+	if fill.attachable(resp) {
+		cs.publishFill(f, &partialEntry{resp: entry, body: fill.body})
+	}
+	resp.Body = &teeBody{
+		body: resp.Body,
+		resp: resp,
+		fill: fill,
+		store: func(body []byte) {
+			entry.Body = body
+			cs.store(req.Context(), key, reasonFill, entry)
+		},
+		finish: func(stored bool) {
+			cs.finishFill(key, f, stored)
+		},
 	}
-	resp.Body.Close()
-
-	resp.Body = io.NopCloser(bytes.NewReader(body))
-
-	cs.cacheResponse(key, req, resp, header, body)
 }
 
 func (cs *CacheServer) Handler(originURL *url.URL) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(withExchange(r.Context()))
+		if cs.accessLog != nil {
+			lw := &loggingWriter{ResponseWriter: w}
+			w = lw
+			defer cs.accessLog.log(r, lw, exchangeFrom(r.Context()))
+		}
+
 		if handler, exists := cs.pathHandlers[r.URL.Path]; exists {
 			handler(w, r)
 			return
 		}
 
+		ctx, rs := cs.startRequestSpan(r.Context(), r)
+		defer rs.endRequest(exchangeFrom(ctx))
+		r = r.WithContext(ctx)
+
+		if r.Method == methodPurge && cs.adminEnabled {
+			cs.handlePurgeMethod(w, r, originURL)
+			return
+		}
+
 		if r.Method != http.MethodGet {
+			if cs.explainResponses {
+				w.Header().Set(explainHeader, cs.explain(originTarget(r, originURL), r.Method, nil).String())
+			}
 			cs.proxyToOrigin(w, r, originURL)
 			return
 		}
 
-		if cs.serveCachedResponse(w, r) {
+		reqHeader := cache.NewParsedHeaders(r.Header)
+		key := cs.cacheKey(originTarget(r, originURL), originURL.Host, reqHeader)
+		if cs.explainResponses {
+			w.Header().Set(explainHeader, cs.explain(key, r.Method, reqHeader).String())
+		}
+		// Objects the origin would not slice are cached whole, so look for
+		// them before trying slices.
+		stale, fwd, served := cs.serveCachedResponse(w, r, originURL, key)
+		if served {
+			return
+		}
+		if stale == nil && cs.sliceSize > 0 && cs.serveSliced(w, r, originURL, key) {
 			return
 		}
 
-		cs.fetchAndCache(w, r, originURL)
+		cs.fetchAndCache(w, r, originURL, key, fwd, stale)
 	})
 }
 
 func (cs *CacheServer) proxyToOrigin(w http.ResponseWriter, r *http.Request, originURL *url.URL) {
 	req := cs.buildOriginRequest(r, originURL)
-	resp, err := cs.transport.RoundTrip(req)
+	resp, err := cs.roundTrip(req)
 	if err != nil {
-		log.Printf("Origin fetch failed for %s: %v", req.URL.String(), err)
+		cs.countError(r.Context(), req.URL.String(), reasonOrigin, err)
+		cs.countMiss(r.Context(), req.URL.String(), fwdMethod, 0)
 		http.Error(w, "Origin fetch failed", http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
+	cs.invalidateGroups(req, resp)
+	cs.countMiss(r.Context(), req.URL.String(), fwdMethod, resp.StatusCode)
+	addCacheStatus(w.Header(), cacheStatusForward(fwdMethod, resp.StatusCode))
+	resp.Body = cs.stats.originBody(resp.Body)
 	cs.copyResponse(w, resp)
 }
 
-func (cs *CacheServer) serveCachedResponse(w http.ResponseWriter, r *http.Request) bool {
-	key := r.URL.String()
-
-	cachedResp, exists := cs.cacheStore.Get(key)
-	if !exists {
-		return false
+// serveCachedResponse serves r from the cache if it can. Otherwise it
+// returns the fwd reason and, when the entry is only stale, the entry.
+func (cs *CacheServer) serveCachedResponse(w http.ResponseWriter, r *http.Request, originURL *url.URL, key string) (*cache.CachedResponse, string, bool) {
+	cachedResp, fwd := cs.lookup(r.Context(), key, cache.NewParsedHeaders(r.Header))
+	switch {
+	case fwd == "":
+		cs.countHit(r.Context(), key, reasonFresh, cachedResp, int64(len(cachedResp.Body)))
+		cs.writeCachedResponse(w, cachedResp, cacheStatusHit(cachedResp))
+		return nil, "", true
+	case fwd == fwdStale && cache.StaleWhileRevalidate(cachedResp):
+		cs.revalidateInBackground(cs.buildOriginRequest(r, originURL), key, cachedResp)
+		cs.countStale(r.Context(), key, reasonStaleWhileRevalidate, cachedResp)
+		cs.writeCachedResponse(w, cachedResp, cacheStatusRevalidating(cachedResp))
+		return nil, "", true
 	}
+	return cachedResp, fwd, false
+}
 
-	reqHeaderStruct := cache.NewParsedHeaders(r.Header)
-	originalReqHeaderStruct := cache.NewParsedHeaders(cachedResp.RequestHeader)
-	respHeader := cache.NewParsedHeaders(cachedResp.ResponseHeader)
-
-	if !cache.IsFresh(cachedResp) || !cache.IsReqAllowedToUseCache(reqHeaderStruct, originalReqHeaderStruct, respHeader) {
-		return false
+// fetchAndCache collapses concurrent misses for key into one origin fetch.
+// Waiters are served from the cache once the leader has stored the
+// response, or fetch on their own if it was not stored in time.
+func (cs *CacheServer) fetchAndCache(w http.ResponseWriter, r *http.Request, originURL *url.URL, key, fwd string, stale *cache.CachedResponse) {
+	f, leader, res := cs.joinFill(r.Context(), key)
+	if !leader {
+		reqHeaderStruct := cache.NewParsedHeaders(r.Header)
+		if partial := res.partial; partial != nil && cs.usable(partial.resp, reqHeaderStruct) == "" {
+			cs.countHit(r.Context(), key, reasonCollapsed, partial.resp, 0)
+			cs.writePartialResponse(w, partial, cacheStatusCollapsed(fwd))
+			return
+		}
+		if res.stored {
+			if cachedResp, miss := cs.lookup(r.Context(), key, reqHeaderStruct); miss == "" {
+				cs.countHit(r.Context(), key, reasonCollapsed, cachedResp, int64(len(cachedResp.Body)))
+				cs.writeCachedResponse(w, cachedResp, cacheStatusCollapsed(fwd))
+				return
+			}
+		}
 	}
 
-	cs.writeCachedResponse(w, cachedResp)
-	return true
+	stored := cs.fetch(w, r, originURL, key, fwd, stale, f)
+	cs.finishFill(key, f, stored)
 }
 
-func (cs *CacheServer) fetchAndCache(w http.ResponseWriter, r *http.Request, originURL *url.URL) {
-	req := cs.buildOriginRequest(r, originURL)
+// fetch streams the origin response to w and reports whether it was stored.
+// Requests collapsed into f are let in on the body while it streams. A
+// stale entry is revalidated, and served if the origin fails and
+// stale-if-error allows it.
+func (cs *CacheServer) fetch(w http.ResponseWriter, r *http.Request, originURL *url.URL, key, fwd string, stale *cache.CachedResponse, f *fill) bool {
+	ctx, fc := cs.newFillContext(r)
+	defer fc.release()
+	req := cs.buildOriginRequest(r, originURL).WithContext(ctx)
+	conditional := false
+	if stale != nil {
+		conditional = addValidators(req.Header, stale)
+	}
 
-	resp, err := cs.transport.RoundTrip(req)
+	resp, err := cs.roundTrip(req)
 	if err != nil {
-		log.Printf("Origin fetch failed for %s: %v", req.URL.String(), err)
+		cs.countError(ctx, key, reasonOrigin, err)
+		if stale != nil && cache.StaleIfError(stale) {
+			cs.countStale(ctx, key, reasonStaleIfError, stale)
+			cs.writeCachedResponse(w, stale, cacheStatusStaleIfError(0))
+			return false
+		}
+		cs.countMiss(ctx, key, fwd, 0)
 		http.Error(w, "Origin fetch failed", http.StatusBadGateway)
-		return
+		return false
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Failed to read response body for %s: %v", req.URL.String(), err)
-		http.Error(w, "Failed to read response body", http.StatusInternalServerError)
-		return
+	if conditional {
+		cs.countRevalidation(ctx, key, stale, resp.StatusCode)
+	}
+	if stale != nil {
+		if resp.StatusCode == http.StatusNotModified {
+			entry := refreshedEntry(stale, resp)
+			cs.store(ctx, key, reasonRefresh, entry)
+			cs.countRevalidated(ctx, key, entry)
+			cs.writeCachedResponse(w, entry, cacheStatusForward(fwd, resp.StatusCode))
+			return true
+		}
+		if isServerError(resp.StatusCode) && cache.StaleIfError(stale) {
+			cs.countStale(ctx, key, reasonStaleIfError, stale)
+			cs.writeCachedResponse(w, stale, cacheStatusStaleIfError(resp.StatusCode))
+			return false
+		}
 	}
+	cs.countMiss(ctx, key, fwd, resp.StatusCode)
+	resp.Body = cs.stats.originBody(resp.Body)
 
+	headerStruct := cache.NewParsedHeaders(resp.Header)
+	cacheable, why := cache.ExplainCacheable(resp.Request.Method, headerStruct)
 	cs.copyHeaders(w, resp)
+	addCacheStatus(w.Header(), cacheStatusForward(fwd, resp.StatusCode))
+	cs.explainStore(w, cacheable, why)
 	w.WriteHeader(resp.StatusCode)
-	w.Write(body)
 
-	headerStruct := cache.NewParsedHeaders(resp.Header)
+	if !cacheable {
+		// Waiters fetch on their own rather than wait for this body.
+		cs.finishFill(key, f, false)
+		fc.markUncacheable()
+		io.Copy(w, resp.Body)
+		return false
+	}
+
+	// Stream to the client while filling the cache. A truncated origin body
+	// leaves the fill incomplete, and so does a failed write to the client
+	// unless the fill may carry on in the background.
+	entry := cs.newCachedResponse(r, resp, headerStruct)
+	fill := cs.newFillBuffer(resp)
+	if fill.attachable(resp) {
+		cs.publishFill(f, &partialEntry{resp: entry, body: fill.body})
+	}
+	client := &clientWriter{w: newFlushWriter(w)}
+	if _, err := io.Copy(client, io.TeeReader(resp.Body, fill)); err != nil {
+		if client.err == nil {
+			cs.countError(ctx, key, reasonStream, err)
+			fill.body.Abort(err)
+			return false
+		}
+		if !fc.detach() {
+			cs.logger.LogAttrs(ctx, slog.LevelWarn, "client went away", slog.String(logKey, key), slog.String(logError, client.err.Error()))
+			fill.body.Abort(err)
+			return false
+		}
+		if _, err := io.Copy(fill, resp.Body); err != nil {
+			cs.countError(ctx, key, reasonStream, err, slog.Bool("background", true))
+			fill.body.Abort(err)
+			return false
+		}
+	}
+	if !fill.end(resp) {
+		return false
+	}
+	entry.Body = fill.body.Bytes()
+	cs.store(ctx, key, reasonFill, entry)
+	return true
+}
 
-	if cache.IsCacheable(resp.Request.Method, headerStruct) {
-		key := cache.GenerateCacheKey(r.URL.String(), headerStruct)
-		cs.cacheResponse(key, r, resp, headerStruct, body)
+// originTarget is the absolute URL r is fetched from. Cache keys are built
+// from it, so entries of different origins never collide and can be purged
+// by host.
+func originTarget(r *http.Request, originURL *url.URL) string {
+	target := url.URL{
+		Scheme:   originURL.Scheme,
+		Host:     originURL.Host,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: r.URL.RawQuery,
 	}
+	return target.String()
 }
 
 func (cs *CacheServer) buildOriginRequest(r *http.Request, originURL *url.URL) *http.Request {
@@ -213,28 +654,45 @@ func (cs *CacheServer) buildOriginRequest(r *http.Request, originURL *url.URL) *
 	return req
 }
 
-func (cs *CacheServer) cacheResponse(key string, req *http.Request, resp *http.Response, header *cache.ParsedHeaders, body []byte) {
+// newCachedResponse captures the metadata of resp for storing. The body is
+// set once it has been read in full.
+func (cs *CacheServer) newCachedResponse(req *http.Request, resp *http.Response, header *cache.ParsedHeaders) *cache.CachedResponse {
 	age := header.GetValidatedAge()
-	cached := &cache.CachedResponse{
+	return &cache.CachedResponse{
 		StatusCode:     resp.StatusCode,
 		RequestHeader:  req.Header.Clone(),
 		ResponseHeader: resp.Header.Clone(),
-		Body:           body,
 		StoredAt:       time.Now(),
 		InitialAge:     age,
 		ProtoMajor:     resp.ProtoMajor,
 		ProtoMinor:     resp.ProtoMinor,
 		Proto:          resp.Proto,
 	}
-	cs.cacheStore.Set(key, cached)
 }
 
-func (cs *CacheServer) writeCachedResponse(w http.ResponseWriter, cachedResp *cache.CachedResponse) {
+func (cs *CacheServer) writeCachedResponse(w http.ResponseWriter, cachedResp *cache.CachedResponse, cacheStatus string) {
+	cs.writeCachedHeader(w, cachedResp, cacheStatus)
+	w.Write(cachedResp.Body)
+}
+
+// writePartialResponse follows the body of a fill that is still in
+// progress. If the fill is abandoned the response is cut short, which the
+// client sees as a truncated body.
+func (cs *CacheServer) writePartialResponse(w http.ResponseWriter, partial *partialEntry, cacheStatus string) {
+	cs.writeCachedHeader(w, partial.resp, cacheStatus)
+	n, err := io.Copy(newFlushWriter(w), partial.body.NewReader())
+	cs.stats.cacheBytes.Add(n)
+	if err != nil {
+		cs.logger.Warn("following in-progress fill failed", slog.String(logError, err.Error()))
+	}
+}
+
+func (cs *CacheServer) writeCachedHeader(w http.ResponseWriter, cachedResp *cache.CachedResponse, cacheStatus string) {
 	age := cache.GetCurrentAge(cachedResp)
 	cs.copyHeadersFromCache(w, cachedResp)
 	w.Header().Set("Age", strconv.Itoa(age))
+	addCacheStatus(w.Header(), cacheStatus)
 	w.WriteHeader(cachedResp.StatusCode)
-	w.Write(cachedResp.Body)
 }
 
 func (cs *CacheServer) copyResponse(w http.ResponseWriter, resp *http.Response) {
@@ -245,6 +703,9 @@ func (cs *CacheServer) copyResponse(w http.ResponseWriter, resp *http.Response)
 
 func (cs *CacheServer) copyHeaders(w http.ResponseWriter, resp *http.Response) {
 	for k, vals := range resp.Header {
+		if cs.hidesHeader(k) {
+			continue
+		}
 		for _, v := range vals {
 			w.Header().Add(k, v)
 		}
@@ -253,6 +714,9 @@ func (cs *CacheServer) copyHeaders(w http.ResponseWriter, resp *http.Response) {
 
 func (cs *CacheServer) copyHeadersFromCache(w http.ResponseWriter, cachedResp *cache.CachedResponse) {
 	for k, vals := range cachedResp.ResponseHeader {
+		if cs.hidesHeader(k) {
+			continue
+		}
 		for _, v := range vals {
 			w.Header().Add(k, v)
 		}
@@ -265,7 +729,9 @@ func (cs *CacheServer) RegisterPath(path string, handler http.HandlerFunc) {
 
 // default status handler for security camp 2025
 func (cs *CacheServer) handleStatus(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"ok","cache":"running"}`))
+	writeJSON(w, struct {
+		Status string `json:"status"`
+		Cache  string `json:"cache"`
+		Stats
+	}{"ok", "running", cs.Stats()})
 }
@@ -1,6 +1,8 @@
 package kyache
 
 import (
+	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -21,9 +23,20 @@ func TestCustomPathHandler(t *testing.T) {
 		t.Errorf("Expected status 200, got %d", w.Code)
 	}
 
-	expectedBody := `{"status":"ok","cache":"running"}`
-	if w.Body.String() != expectedBody {
-		t.Errorf("Expected body %q, got %q", expectedBody, w.Body.String())
+	var status struct {
+		Status    string `json:"status"`
+		Cache     string `json:"cache"`
+		Transport string `json:"transport"`
+		Entries   int    `json:"entries"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Decoding body %q: %v", w.Body.String(), err)
+	}
+	if status.Status != "ok" || status.Cache != "running" {
+		t.Errorf("Expected ok/running, got %q/%q", status.Status, status.Cache)
+	}
+	if status.Transport != "HTTP/1.1 (HTTP/2 over TLS)" || status.Entries != 0 {
+		t.Errorf("Expected HTTP/2 with no entries, got %q with %d", status.Transport, status.Entries)
 	}
 
 	contentType := w.Header().Get("Content-Type")
@@ -56,3 +69,97 @@ func TestRegisterPath(t *testing.T) {
 		t.Errorf("Expected body %q, got %q", expectedBody, w.Body.String())
 	}
 }
+
+func newTestOrigin(t *testing.T, handler http.HandlerFunc) *url.URL {
+	t.Helper()
+	origin := httptest.NewServer(handler)
+	t.Cleanup(origin.Close)
+	originURL, _ := url.Parse(origin.URL)
+	return originURL
+}
+
+func TestFetchAndCacheStreamsAndStores(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("streamed body"))
+	})
+	cs := New(&Config{})
+	handler := cs.Handler(originURL)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/obj", nil))
+	if w.Body.String() != "streamed body" {
+		t.Fatalf("body = %q, want %q", w.Body.String(), "streamed body")
+	}
+
+	cached, ok := cs.cacheStore.Get(originURL.String() + "/obj")
+	if !ok || string(cached.Body) != "streamed body" {
+		t.Fatalf("cached entry = %v, %v", cached, ok)
+	}
+}
+
+func TestFetchAndCacheSkipsObjectsOverMaxSize(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("0123456789"))
+	})
+	cs := New(&Config{MaxObjectSize: 5})
+	handler := cs.Handler(originURL)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/big", nil))
+	if w.Body.String() != "0123456789" {
+		t.Fatalf("body = %q, want full passthrough", w.Body.String())
+	}
+	if _, ok := cs.cacheStore.Get(originURL.String() + "/big"); ok {
+		t.Errorf("object larger than MaxObjectSize was cached")
+	}
+}
+
+func TestFetchAndCacheDiscardsTruncatedBodies(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("only part"))
+		// Returning early closes the connection short of Content-Length.
+	})
+	cs := New(&Config{})
+	handler := cs.Handler(originURL)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/truncated", nil))
+	if _, ok := cs.cacheStore.Get(originURL.String() + "/truncated"); ok {
+		t.Errorf("truncated body was cached")
+	}
+}
+
+func TestRoundTripStoresBodyOnlyAfterFullRead(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("payload"))
+	})
+	cs := New(&Config{})
+	client := &http.Client{Transport: cs}
+	target := originURL.String() + "/rt"
+
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, ok := cs.cacheStore.Get(target); ok {
+		t.Fatalf("body closed before EOF was cached")
+	}
+
+	resp, err = client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "payload" {
+		t.Fatalf("body = %q", body)
+	}
+	if cached, ok := cs.cacheStore.Get(target); !ok || string(cached.Body) != "payload" {
+		t.Fatalf("cached entry = %v, %v", cached, ok)
+	}
+}
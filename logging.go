@@ -0,0 +1,77 @@
+package kyache
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Attribute keys shared by kyache's log records.
+const (
+	logKey           = "key"
+	logOrigin        = "origin"
+	logStatus        = "status"
+	logDecision      = "decision"
+	logReason        = "reason"
+	logDuration      = "duration"
+	logOriginLatency = "origin_latency"
+	logError         = "error"
+)
+
+func newDebugHosts(hosts []string) map[string]bool {
+	m := make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		m[strings.ToLower(host)] = true
+	}
+	return m
+}
+
+// eventAttrs describes e as log attributes. decision is the kind of event,
+// such as "hit" or "store".
+func eventAttrs(decision string, e Event) []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String(logKey, e.Key),
+		slog.String(logOrigin, entryHost(e.Key)),
+		slog.String(logDecision, decision),
+		slog.String(logReason, e.Reason),
+	}
+	if e.Status != 0 {
+		attrs = append(attrs, slog.Int(logStatus, e.Status))
+	}
+	if e.Elapsed != 0 {
+		attrs = append(attrs, slog.Duration(logDuration, e.Elapsed))
+	}
+	if e.OriginLatency != 0 {
+		attrs = append(attrs, slog.Duration(logOriginLatency, e.OriginLatency))
+	}
+	if e.Err != nil {
+		attrs = append(attrs, slog.String(logError, e.Err.Error()))
+	}
+	return attrs
+}
+
+// logDecision logs a cache decision at debug level. Decisions for hosts in
+// Config.DebugHosts are logged whatever level the logger's handler is set
+// to, so one host can be debugged without flooding the logs.
+//
+// Decisions are logged on every request, so the check whether to log comes
+// before any attribute is built.
+func (cs *CacheServer) logDecision(ctx context.Context, decision string, e Event) {
+	if cs.logger.Enabled(ctx, slog.LevelDebug) {
+		cs.logger.LogAttrs(ctx, slog.LevelDebug, "cache decision", eventAttrs(decision, e)...)
+		return
+	}
+	if len(cs.debugHosts) == 0 || !cs.debugHosts[entryHost(e.Key)] {
+		return
+	}
+	r := slog.NewRecord(time.Now(), slog.LevelDebug, "cache decision", 0)
+	r.AddAttrs(eventAttrs(decision, e)...)
+	cs.logger.Handler().Handle(ctx, r)
+}
+
+// logOriginError logs a failed origin fetch. attrs add detail, such as the
+// slice being fetched.
+func (cs *CacheServer) logOriginError(ctx context.Context, e Event, attrs ...slog.Attr) {
+	cs.logger.LogAttrs(ctx, slog.LevelError, "origin fetch failed", append(eventAttrs(eventError, e), attrs...)...)
+}
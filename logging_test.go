@@ -0,0 +1,77 @@
+package kyache
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var rec map[string]any
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestDebugHostsLogDecisions(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	})
+	for _, debug := range []bool{false, true} {
+		var buf bytes.Buffer
+		config := &Config{Logger: slog.New(slog.NewJSONHandler(&buf, nil))}
+		if debug {
+			config.DebugHosts = []string{originURL.Host}
+		}
+		handler := New(config).Handler(originURL)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/obj", nil))
+
+		records := logRecords(t, &buf)
+		if !debug {
+			if len(records) != 0 {
+				t.Errorf("logged %v at info level", records)
+			}
+			continue
+		}
+		if len(records) != 2 {
+			t.Fatalf("logged %d records, want miss and store", len(records))
+		}
+		miss := records[0]
+		if miss["level"] != "DEBUG" || miss["decision"] != "miss" || miss["reason"] != "uri-miss" ||
+			miss["origin"] != originURL.Host || miss["key"] != originURL.String()+"/obj" || miss["status"] != 200.0 {
+			t.Errorf("miss record = %v", miss)
+		}
+		if _, ok := miss["duration"]; !ok {
+			t.Errorf("miss record has no duration: %v", miss)
+		}
+	}
+}
+
+func TestOriginErrorsAreLogged(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	})
+	var buf bytes.Buffer
+	handler := New(&Config{Logger: slog.New(slog.NewJSONHandler(&buf, nil))}).Handler(originURL)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/obj", nil))
+
+	records := logRecords(t, &buf)
+	if len(records) != 1 {
+		t.Fatalf("logged %v, want one error", records)
+	}
+	rec := records[0]
+	if rec["level"] != "ERROR" || rec["decision"] != "error" || rec["reason"] != "origin" || rec["error"] == nil {
+		t.Errorf("error record = %v", rec)
+	}
+}
@@ -0,0 +1,285 @@
+package kyache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons an entry leaves the cache, as reported by the
+// kyache_evictions_total metric.
+const (
+	evictPurge      = "purge"
+	evictBan        = "ban"
+	evictGeneration = "generation"
+	evictCapacity   = "capacity"
+	evictReplaced   = "replaced"
+)
+
+var (
+	fetchLatencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	responseSizeBuckets = []float64{1 << 8, 1 << 10, 1 << 12, 1 << 14, 1 << 16, 1 << 18, 1 << 20, 1 << 22, 1 << 24, 1 << 26}
+)
+
+// metrics keeps the per origin host series served on /metrics. Requests
+// only touch atomics once a host has been seen, so they never contend on a
+// lock.
+type metrics struct {
+	hosts sync.Map // host -> *hostMetrics
+}
+
+// evictReasons are the reasons of kyache_evictions_total, in the order of
+// hostMetrics.evictions.
+var evictReasons = [...]string{evictPurge, evictBan, evictGeneration, evictCapacity, evictReplaced}
+
+// hostMetrics counts by status class with index 0 for "error" and i for
+// "ixx".
+type hostMetrics struct {
+	hits, misses, stores [10]atomic.Int64
+	evictions            [len(evictReasons)]atomic.Int64
+	fetchLatency         *histogram
+	responseSize         *histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{}
+}
+
+func (m *metrics) host(host string) *hostMetrics {
+	if hm, ok := m.hosts.Load(host); ok {
+		return hm.(*hostMetrics)
+	}
+	hm, _ := m.hosts.LoadOrStore(host, &hostMetrics{
+		fetchLatency: newHistogram(fetchLatencyBuckets),
+		responseSize: newHistogram(responseSizeBuckets),
+	})
+	return hm.(*hostMetrics)
+}
+
+func (m *metrics) hit(host string, status int) {
+	m.host(host).hits[statusIndex(status)].Add(1)
+}
+
+func (m *metrics) miss(host string, status int) {
+	m.host(host).misses[statusIndex(status)].Add(1)
+}
+
+func (m *metrics) store(host string, status int) {
+	m.host(host).stores[statusIndex(status)].Add(1)
+}
+
+func (m *metrics) evict(host, reason string) {
+	for i, r := range evictReasons {
+		if r == reason {
+			m.host(host).evictions[i].Add(1)
+			return
+		}
+	}
+}
+
+func (m *metrics) originFetch(host string, d time.Duration) {
+	m.host(host).fetchLatency.observe(d.Seconds())
+}
+
+func (m *metrics) originResponseSize(host string, n int64) {
+	m.host(host).responseSize.observe(float64(n))
+}
+
+// statusIndex returns the index of status in a hostMetrics counter array,
+// 0 when the origin could not be reached.
+func statusIndex(status int) int {
+	if status < 100 || status > 999 {
+		return 0
+	}
+	return status / 100
+}
+
+// statusClass returns "2xx" and the like for a status index, or "error".
+func statusClass(i int) string {
+	if i == 0 {
+		return "error"
+	}
+	return strconv.Itoa(i) + "xx"
+}
+
+type histogram struct {
+	bounds []float64
+	counts []atomic.Int64 // per bucket, with one more for +Inf
+	sum    atomic.Uint64  // float64 bits
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, v)].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// sizeBody reports the number of bytes read from an origin body once it is
+// read to the end or closed.
+type sizeBody struct {
+	io.ReadCloser
+	n    int64
+	done func(n int64)
+}
+
+func (sb *sizeBody) Read(p []byte) (int, error) {
+	n, err := sb.ReadCloser.Read(p)
+	sb.n += int64(n)
+	if err == io.EOF {
+		sb.report()
+	}
+	return n, err
+}
+
+func (sb *sizeBody) Close() error {
+	sb.report()
+	return sb.ReadCloser.Close()
+}
+
+func (sb *sizeBody) report() {
+	if sb.done != nil {
+		sb.done(sb.n)
+		sb.done = nil
+	}
+}
+
+// handleMetrics serves the metrics in the Prometheus text format.
+func (cs *CacheServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	cs.writeMetrics(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (cs *CacheServer) writeMetrics(w io.Writer) {
+	usage := cs.indexed.usageByHost()
+
+	byHost := make(map[string]*hostMetrics)
+	cs.metrics.hosts.Range(func(host, hm any) bool {
+		byHost[host.(string)] = hm.(*hostMetrics)
+		return true
+	})
+	hosts := make([]string, 0, len(byHost))
+	for host := range byHost {
+		hosts = append(hosts, host)
+	}
+	for host := range usage {
+		if _, ok := byHost[host]; !ok {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	counters := []struct {
+		name, help, label string
+		values            func(hm *hostMetrics) []atomic.Int64
+		labels            func(i int) string
+	}{
+		{"kyache_hits_total", "Responses served from the cache, including stale and revalidated ones.", "status_class",
+			func(hm *hostMetrics) []atomic.Int64 { return hm.hits[:] }, statusClass},
+		{"kyache_misses_total", "Responses served from the origin.", "status_class",
+			func(hm *hostMetrics) []atomic.Int64 { return hm.misses[:] }, statusClass},
+		{"kyache_stores_total", "Responses written to the cache.", "status_class",
+			func(hm *hostMetrics) []atomic.Int64 { return hm.stores[:] }, statusClass},
+		{"kyache_evictions_total", "Entries removed from the cache.", "reason",
+			func(hm *hostMetrics) []atomic.Int64 { return hm.evictions[:] }, func(i int) string { return evictReasons[i] }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+		for _, host := range hosts {
+			hm := byHost[host]
+			if hm == nil {
+				continue
+			}
+			values := c.values(hm)
+			labels := make(map[string]int64)
+			for i := range values {
+				if n := values[i].Load(); n > 0 {
+					labels[c.labels(i)] = n
+				}
+			}
+			for _, v := range sortedKeys(labels) {
+				fmt.Fprintf(w, "%s{host=%s,%s=%s} %d\n", c.name, quoteLabel(host), c.label, quoteLabel(v), labels[v])
+			}
+		}
+	}
+
+	histograms := []struct {
+		name, help string
+		value      func(hm *hostMetrics) *histogram
+	}{
+		{"kyache_origin_fetch_duration_seconds", "Time until the origin's response headers arrived.",
+			func(hm *hostMetrics) *histogram { return hm.fetchLatency }},
+		{"kyache_origin_response_size_bytes", "Size of the response bodies read from the origin.",
+			func(hm *hostMetrics) *histogram { return hm.responseSize }},
+	}
+	for _, h := range histograms {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+		for _, host := range hosts {
+			if hm := byHost[host]; hm != nil {
+				writeHistogram(w, h.name, quoteLabel(host), h.value(hm))
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP kyache_entries Entries in the cache.\n# TYPE kyache_entries gauge\n")
+	for _, host := range hosts {
+		fmt.Fprintf(w, "kyache_entries{host=%s} %d\n", quoteLabel(host), usage[host].entries)
+	}
+	fmt.Fprintf(w, "# HELP kyache_bytes Approximate size of the entries in the cache.\n# TYPE kyache_bytes gauge\n")
+	for _, host := range hosts {
+		fmt.Fprintf(w, "kyache_bytes{host=%s} %d\n", quoteLabel(host), usage[host].bytes)
+	}
+}
+
+// writeHistogram writes h as it was when its buckets were read. The count
+// is taken from the buckets so that it agrees with them while observations
+// are still coming in.
+func writeHistogram(w io.Writer, name, host string, h *histogram) {
+	var cumulative int64
+	buckets := make([]int64, len(h.counts))
+	for i := range h.counts {
+		cumulative += h.counts[i].Load()
+		buckets[i] = cumulative
+	}
+	if cumulative == 0 {
+		return
+	}
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{host=%s,le=\"%s\"} %d\n", name, host, strconv.FormatFloat(bound, 'g', -1, 64), buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{host=%s,le=\"+Inf\"} %d\n", name, host, cumulative)
+	fmt.Fprintf(w, "%s_sum{host=%s} %s\n", name, host, strconv.FormatFloat(math.Float64frombits(h.sum.Load()), 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count{host=%s} %d\n", name, host, cumulative)
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
@@ -0,0 +1,119 @@
+package kyache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+func scrape(t *testing.T, cs *CacheServer) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	cs.handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	return w.Body.String()
+}
+
+func TestMetricsPerOriginHost(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte("0123456789"))
+	})
+	cs := New(&Config{})
+	handler := cs.Handler(originURL)
+	for _, path := range []string{"/a", "/a", "/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	cs.Purge(originURL.String() + "/missing")
+
+	host := `host="` + originURL.Host + `"`
+	body := scrape(t, cs)
+	for _, want := range []string{
+		"# TYPE kyache_hits_total counter",
+		"kyache_hits_total{" + host + `,status_class="2xx"} 1`,
+		"kyache_misses_total{" + host + `,status_class="2xx"} 1`,
+		"kyache_misses_total{" + host + `,status_class="4xx"} 1`,
+		"kyache_stores_total{" + host + `,status_class="4xx"} 1`,
+		"kyache_evictions_total{" + host + `,reason="purge"} 1`,
+		"kyache_origin_fetch_duration_seconds_count{" + host + "} 2",
+		"kyache_origin_response_size_bytes_bucket{" + host + `,le="256"} 2`,
+		"kyache_origin_response_size_bytes_sum{" + host + "} 20",
+		"kyache_entries{" + host + "} 1",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsCountCapacityEvictions(t *testing.T) {
+	// Every entry is over this budget, so the store evicts it right away.
+	store, err := cache.NewDiskStore(t.TempDir(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := New(&Config{Store: store})
+	cs.store(context.Background(), "http://example.com/a", reasonFill, &cache.CachedResponse{StatusCode: 200, Body: []byte("0123456789"), StoredAt: time.Now()})
+
+	body := scrape(t, cs)
+	for _, want := range []string{
+		`kyache_evictions_total{host="example.com",reason="capacity"} 1`,
+		`kyache_entries{host="example.com"} 0`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics lack %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsEndpointIsOptIn(t *testing.T) {
+	if _, ok := New(&Config{}).pathHandlers["/metrics"]; ok {
+		t.Errorf("/metrics registered without EnableMetrics")
+	}
+	if _, ok := New(&Config{EnableMetrics: true}).pathHandlers["/metrics"]; !ok {
+		t.Errorf("/metrics not registered with EnableMetrics")
+	}
+}
+
+func TestMetricsCountReopenedDiskEntries(t *testing.T) {
+	dir := t.TempDir()
+	store, err := cache.NewDiskStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set("http://example.com/a", &cache.CachedResponse{StatusCode: 200, Body: []byte("0123456789"), StoredAt: time.Now()})
+
+	reopened, err := cache.NewDiskStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := New(&Config{Store: reopened})
+	if body := scrape(t, cs); !strings.Contains(body, `kyache_entries{host="example.com"} 1`+"\n") {
+		t.Errorf("metrics lack the reopened entry:\n%s", body)
+	}
+}
+
+func TestEntryHostMatchesKeyHost(t *testing.T) {
+	for _, key := range []string{
+		"http://Example.com/a?b#c",
+		"https://example.com:8443",
+		"http://user@example.com/",
+		"http://example.com?q",
+		cache.GenerateCacheKeyForGeneration("http://example.com/a", nil, 3),
+	} {
+		want, _, _ := keyHost(key)
+		if got := entryHost(key); got != want {
+			t.Errorf("entryHost(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
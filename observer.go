@@ -0,0 +1,157 @@
+package kyache
+
+import (
+	"context"
+	"time"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+// Observer is told about every cache decision as it is made. Its methods
+// are called synchronously, on the goroutine handling the request, so they
+// must return quickly and be safe for concurrent use. Embed NopObserver to
+// implement only some of them.
+type Observer interface {
+	// OnHit is called when a response is served from the cache. Reason is
+	// "fresh", "collapsed" (from a fill another request started),
+	// "revalidated" (after a 304), "stale-while-revalidate" or
+	// "stale-if-error".
+	OnHit(Event)
+	// OnMiss is called when a response is served from the origin. Reason is
+	// the fwd parameter of the Cache-Status header: "uri-miss", "miss" (the
+	// entry cannot be used for this request), "stale", "partial" (slices
+	// were missing) or "method" for requests that bypass the cache.
+	OnMiss(Event)
+	// OnStore is called when an entry is written. Reason is "fill" for a
+	// response fetched from the origin, "refresh" for a stored response
+	// the origin confirmed with a 304 and "invalidate" for an entry marked
+	// stale because the object changed.
+	OnStore(Event)
+	// OnEvict is called when an entry is removed. Reason is "purge", "ban",
+	// "generation", "capacity" or "replaced" (a slice of an object version
+	// the origin replaced). Response is nil.
+	OnEvict(Event)
+	// OnRevalidate is called when the origin answers a conditional request
+	// for a stale entry, in the foreground or the background. Reason is
+	// "not-modified" or "modified".
+	OnRevalidate(Event)
+	// OnError is called when fetching from the origin fails. Reason is
+	// "origin" when no response arrived, "stream" when the body broke off,
+	// "revalidate" for background revalidations and "slice" for slices.
+	OnError(Event)
+}
+
+// Event kinds, named after the Observer methods.
+const (
+	eventHit        = "hit"
+	eventMiss       = "miss"
+	eventStore      = "store"
+	eventEvict      = "evict"
+	eventRevalidate = "revalidate"
+	eventError      = "error"
+)
+
+// Event reasons, as documented on Observer.
+const (
+	reasonFresh                = "fresh"
+	reasonCollapsed            = "collapsed"
+	reasonRevalidated          = "revalidated"
+	reasonStaleWhileRevalidate = "stale-while-revalidate"
+	reasonStaleIfError         = "stale-if-error"
+
+	reasonFill       = "fill"
+	reasonRefresh    = "refresh"
+	reasonInvalidate = "invalidate"
+
+	reasonNotModified = "not-modified"
+	reasonModified    = "modified"
+
+	reasonOrigin     = "origin"
+	reasonStream     = "stream"
+	reasonRevalidate = "revalidate"
+	reasonSlice      = "slice"
+)
+
+// Event describes one cache decision.
+type Event struct {
+	Key    string
+	Reason string
+	// Status is the status of the response served or fetched, or zero if
+	// there is none.
+	Status int
+	// Response is the stored entry the event is about, if any. It is shared
+	// with the cache and must not be modified.
+	Response *cache.CachedResponse
+	// Elapsed is the time since kyache started handling the request, or
+	// since a background revalidation started. It is zero for evictions.
+	Elapsed time.Duration
+	// OriginLatency is how long the origin took to send its response
+	// headers, once the request has been to the origin.
+	OriginLatency time.Duration
+	// Err is set for OnError.
+	Err error
+}
+
+// NopObserver ignores every event.
+type NopObserver struct{}
+
+func (NopObserver) OnHit(Event)        {}
+func (NopObserver) OnMiss(Event)       {}
+func (NopObserver) OnStore(Event)      {}
+func (NopObserver) OnEvict(Event)      {}
+func (NopObserver) OnRevalidate(Event) {}
+func (NopObserver) OnError(Event)      {}
+
+// exchange follows one request, or one background revalidation, through
+// the cache. It travels in the request context.
+type exchange struct {
+	start         time.Time
+	originStatus  int
+	originLatency time.Duration
+	// result is the cache result shown in the access log.
+	result string
+}
+
+type exchangeKey struct{}
+
+// withExchange starts a new exchange, replacing any ctx already carries.
+func withExchange(ctx context.Context) context.Context {
+	return context.WithValue(ctx, exchangeKey{}, &exchange{start: time.Now()})
+}
+
+func exchangeFrom(ctx context.Context) *exchange {
+	ex, _ := ctx.Value(exchangeKey{}).(*exchange)
+	return ex
+}
+
+// notify passes an event of kind to the observer and the event stream, and
+// logs it. Errors are logged by their callers, which know more about them.
+func (cs *CacheServer) notify(ctx context.Context, kind string, e Event) {
+	cs.events.publish(kind, e)
+	switch kind {
+	case eventHit:
+		cs.observer.OnHit(e)
+	case eventMiss:
+		cs.observer.OnMiss(e)
+	case eventStore:
+		cs.observer.OnStore(e)
+	case eventEvict:
+		cs.observer.OnEvict(e)
+	case eventRevalidate:
+		cs.observer.OnRevalidate(e)
+	case eventError:
+		cs.observer.OnError(e)
+		return
+	}
+	cs.logDecision(ctx, kind, e)
+}
+
+// event returns an Event for key with the timings of the exchange in ctx.
+func event(ctx context.Context, key, reason string) Event {
+	e := Event{Key: key, Reason: reason}
+	if ex := exchangeFrom(ctx); ex != nil {
+		e.Elapsed = time.Since(ex.start)
+		e.OriginLatency = ex.originLatency
+	}
+	return e
+}
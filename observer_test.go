@@ -0,0 +1,95 @@
+package kyache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// recordingObserver records events as "kind reason status".
+type recordingObserver struct {
+	mu     sync.Mutex
+	events []string
+	last   map[string]Event
+}
+
+func (o *recordingObserver) record(kind string, e Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, fmt.Sprintf("%s %s %d", kind, e.Reason, e.Status))
+	if o.last == nil {
+		o.last = make(map[string]Event)
+	}
+	o.last[kind] = e
+}
+
+func (o *recordingObserver) OnHit(e Event)        { o.record("hit", e) }
+func (o *recordingObserver) OnMiss(e Event)       { o.record("miss", e) }
+func (o *recordingObserver) OnStore(e Event)      { o.record("store", e) }
+func (o *recordingObserver) OnEvict(e Event)      { o.record("evict", e) }
+func (o *recordingObserver) OnRevalidate(e Event) { o.record("revalidate", e) }
+func (o *recordingObserver) OnError(e Event)      { o.record("error", e) }
+
+func TestObserverSeesCacheDecisions(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	})
+	o := &recordingObserver{}
+	cs := New(&Config{Observer: o})
+	handler := cs.Handler(originURL)
+	for range 2 {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/obj", nil))
+	}
+	cs.Purge(originURL.String() + "/obj")
+
+	want := []string{"miss uri-miss 200", "store fill 200", "hit fresh 200", "evict purge 0"}
+	if !reflect.DeepEqual(o.events, want) {
+		t.Errorf("events = %q, want %q", o.events, want)
+	}
+	if hit := o.last["hit"]; hit.Key != originURL.String()+"/obj" || hit.Response == nil || hit.Elapsed <= 0 {
+		t.Errorf("hit event = %+v", hit)
+	}
+	if miss := o.last["miss"]; miss.OriginLatency <= 0 {
+		t.Errorf("miss event has no origin latency: %+v", miss)
+	}
+}
+
+func TestObserverSeesRevalidationsAndErrors(t *testing.T) {
+	down := false
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		if down {
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body"))
+	})
+	o := &recordingObserver{}
+	cs := New(&Config{Observer: o})
+	handler := cs.Handler(originURL)
+	for range 2 {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/obj", nil))
+	}
+	down = true
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/obj", nil))
+
+	want := []string{
+		"miss uri-miss 200", "store fill 200",
+		"revalidate not-modified 304", "store refresh 200", "hit revalidated 200",
+		"error origin 0", "miss stale 0",
+	}
+	if !reflect.DeepEqual(o.events, want) {
+		t.Errorf("events = %q, want %q", o.events, want)
+	}
+	if o.last["error"].Err == nil {
+		t.Errorf("error event has no error")
+	}
+}
@@ -0,0 +1,118 @@
+package kyache
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+// Cache keys are absolute URLs. Entries derived from a URL, such as the
+// slices of a large object, use the URL followed by "#" and a suffix, so
+// purging a URL removes them too.
+//
+// Every purge has a soft variant that keeps the entries but marks them
+// stale. They are then revalidated with a conditional request on their next
+// use, or served stale where stale-while-revalidate or stale-if-error allow
+// it, so purging a hot object does not send every client to the origin.
+
+// Purge removes every stored response for rawURL, including its slices, and
+// returns how many entries were removed.
+func (cs *CacheServer) Purge(rawURL string) int {
+	return cs.purgeKeys(cs.matchingKeys(matchURL(rawURL)), false)
+}
+
+// SoftPurge marks every stored response for rawURL as stale and returns how
+// many entries were marked.
+func (cs *CacheServer) SoftPurge(rawURL string) int {
+	return cs.purgeKeys(cs.matchingKeys(matchURL(rawURL)), true)
+}
+
+// PurgePrefix removes every stored response whose URL starts with prefix,
+// such as "https://example.com/news/".
+func (cs *CacheServer) PurgePrefix(prefix string) int {
+	return cs.purgeKeys(cs.matchingKeys(matchPrefix(prefix)), false)
+}
+
+// SoftPurgePrefix is the soft variant of PurgePrefix.
+func (cs *CacheServer) SoftPurgePrefix(prefix string) int {
+	return cs.purgeKeys(cs.matchingKeys(matchPrefix(prefix)), true)
+}
+
+// PurgeHost removes every stored response for host. A host without a port
+// matches every port.
+func (cs *CacheServer) PurgeHost(host string) int {
+	return cs.purgeKeys(cs.matchingKeys(matchHost(host)), false)
+}
+
+// SoftPurgeHost is the soft variant of PurgeHost.
+func (cs *CacheServer) SoftPurgeHost(host string) int {
+	return cs.purgeKeys(cs.matchingKeys(matchHost(host)), true)
+}
+
+func matchURL(rawURL string) func(key string) bool {
+	return func(key string) bool {
+		return key == rawURL || strings.HasPrefix(key, rawURL+"#")
+	}
+}
+
+func matchPrefix(prefix string) func(key string) bool {
+	return func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}
+}
+
+func matchHost(host string) func(key string) bool {
+	return func(key string) bool {
+		u, err := url.Parse(key)
+		if err != nil {
+			return false
+		}
+		return strings.EqualFold(u.Host, host) || strings.EqualFold(u.Hostname(), host)
+	}
+}
+
+func (cs *CacheServer) matchingKeys(match func(key string) bool) []string {
+	var keys []string
+	cache.RangeKeys(cs.cacheStore, func(key string) bool {
+		if match(key) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// purgeKeys removes keys, or marks them stale when soft is set, and returns
+// how many were present.
+func (cs *CacheServer) purgeKeys(keys []string, soft bool) int {
+	purged := 0
+	now := time.Now()
+	for _, key := range keys {
+		if !soft {
+			if cs.evict(key, evictPurge) {
+				purged++
+			}
+			continue
+		}
+		resp, ok := cs.cacheStore.Get(key)
+		if !ok {
+			continue
+		}
+		if resp.InvalidatedAt.IsZero() {
+			cs.cacheStore.Set(key, invalidatedCopy(resp, now))
+		}
+		cs.events.publish(eventPurge, Event{Key: key, Reason: purgeSoft})
+		purged++
+	}
+	return purged
+}
+
+// invalidatedCopy returns resp marked as invalidated at t. Stored entries
+// may be shared with readers, so they are never modified in place.
+func invalidatedCopy(resp *cache.CachedResponse, t time.Time) *cache.CachedResponse {
+	invalidated := *resp
+	invalidated.InvalidatedAt = t
+	return &invalidated
+}
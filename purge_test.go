@@ -0,0 +1,88 @@
+package kyache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+func storeTestEntries(cs *CacheServer, keys ...string) {
+	for _, key := range keys {
+		cs.cacheStore.Set(key, &cache.CachedResponse{
+			StatusCode:     http.StatusOK,
+			RequestHeader:  http.Header{},
+			ResponseHeader: http.Header{"Cache-Control": []string{"max-age=600"}},
+			StoredAt:       time.Now(),
+		})
+	}
+}
+
+func TestPurgeRemovesURLAndItsSlices(t *testing.T) {
+	cs := New(&Config{})
+	storeTestEntries(cs,
+		"http://example.com/a",
+		sliceMetaKey("http://example.com/a"),
+		sliceKey("http://example.com/a", `"v1"`, 0),
+		"http://example.com/ab",
+	)
+
+	if n := cs.Purge("http://example.com/a"); n != 3 {
+		t.Errorf("Purge = %d, want 3", n)
+	}
+	if _, ok := cs.cacheStore.Get("http://example.com/ab"); !ok {
+		t.Errorf("Purge removed an entry for another URL")
+	}
+	if n := cs.Purge("http://example.com/a"); n != 0 {
+		t.Errorf("second Purge = %d, want 0", n)
+	}
+}
+
+func TestPurgePrefixAndHost(t *testing.T) {
+	cs := New(&Config{})
+	storeTestEntries(cs,
+		"http://example.com/news/1",
+		"http://example.com/news/2",
+		"http://example.com/about",
+		"http://example.com:8080/news/1",
+		"http://other.example/news/1",
+	)
+
+	if n := cs.PurgePrefix("http://example.com/news/"); n != 2 {
+		t.Errorf("PurgePrefix = %d, want 2", n)
+	}
+	if n := cs.PurgeHost("example.com"); n != 2 {
+		t.Errorf("PurgeHost = %d, want 2", n)
+	}
+	if _, ok := cs.cacheStore.Get("http://other.example/news/1"); !ok {
+		t.Errorf("PurgeHost removed an entry for another host")
+	}
+}
+
+func TestPurgeEndpointAndMethod(t *testing.T) {
+	originURL, _ := url.Parse("http://example.com")
+	cs := New(&Config{EnableAdmin: true})
+	storeTestEntries(cs, "http://example.com/a", "http://example.com/b")
+	handler := cs.Handler(originURL)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/purge?url=http://example.com/a", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"purged":1}` {
+		t.Errorf("admin purge = %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(methodPurge, "/b", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"purged":1}` {
+		t.Errorf("PURGE = %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/purge", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("admin purge without a selector = %d, want 400", w.Code)
+	}
+}
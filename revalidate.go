@@ -0,0 +1,114 @@
+package kyache
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+// addValidators turns an origin request into a conditional one for stale,
+// and reports whether stale has a validator to send.
+func addValidators(h http.Header, stale *cache.CachedResponse) bool {
+	etag := stale.ResponseHeader.Get("ETag")
+	lastModified := stale.ResponseHeader.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return false
+	}
+	h.Del("If-None-Match")
+	h.Del("If-Modified-Since")
+	if etag != "" {
+		h.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		h.Set("If-Modified-Since", lastModified)
+	}
+	return true
+}
+
+// refreshedEntry applies a 304 to stale: its header fields replace the
+// stored ones (RFC 9111 Section 4.3.4) and the entry starts a new lifetime.
+func refreshedEntry(stale *cache.CachedResponse, resp *http.Response) *cache.CachedResponse {
+	entry := *stale
+	entry.ResponseHeader = stale.ResponseHeader.Clone()
+	for name, values := range resp.Header {
+		if name == "Content-Length" {
+			continue
+		}
+		entry.ResponseHeader[name] = append([]string(nil), values...)
+	}
+	entry.StoredAt = time.Now()
+	entry.InitialAge = cache.NewParsedHeaders(resp.Header).GetValidatedAge()
+	entry.InvalidatedAt = time.Time{}
+	return &entry
+}
+
+func isServerError(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// revalidateInBackground refreshes stale after it has been served under
+// stale-while-revalidate. Only one refresh per key runs at a time.
+// template is the origin request without validators; it is not used by the
+// caller afterwards.
+func (cs *CacheServer) revalidateInBackground(template *http.Request, key string, stale *cache.CachedResponse) {
+	f, leader := cs.fills.join(key)
+	if !leader {
+		return
+	}
+	go func() {
+		timeout := cs.backgroundFillTimeout
+		if timeout == 0 {
+			timeout = DefaultBackgroundFillTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(template.Context()), timeout)
+		defer cancel()
+		ctx = withExchange(ctx)
+		cs.finishFill(key, f, cs.revalidate(ctx, template, key, stale))
+	}()
+}
+
+// revalidate fetches key again with a conditional request and stores the
+// result. It reports whether an entry was stored.
+func (cs *CacheServer) revalidate(ctx context.Context, template *http.Request, key string, stale *cache.CachedResponse) bool {
+	req := template.Clone(ctx)
+	conditional := addValidators(req.Header, stale)
+	resp, err := cs.roundTrip(req)
+	if err != nil {
+		cs.countError(ctx, key, reasonRevalidate, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if conditional {
+		cs.countRevalidation(ctx, key, stale, resp.StatusCode)
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		cs.store(ctx, key, reasonRefresh, refreshedEntry(stale, resp))
+		return true
+	}
+	headerStruct := cache.NewParsedHeaders(resp.Header)
+	if !cache.IsCacheable(req.Method, headerStruct) {
+		return false
+	}
+	entry := cs.newCachedResponse(template, resp, headerStruct)
+	fill := cs.newFillBuffer(resp)
+	if _, err := io.Copy(fill, resp.Body); err != nil {
+		cs.countError(ctx, key, reasonRevalidate, err)
+		fill.body.Abort(err)
+		return false
+	}
+	if !fill.end(resp) {
+		return false
+	}
+	entry.Body = fill.body.Bytes()
+	cs.store(ctx, key, reasonFill, entry)
+	return true
+}
@@ -0,0 +1,153 @@
+package kyache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSoftPurgeRevalidatesWithNotModified(t *testing.T) {
+	var fetches, notModified atomic.Int32
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "max-age=600")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body"))
+	})
+	cs := New(&Config{})
+	handler := cs.Handler(originURL)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page", nil))
+
+	if n := cs.SoftPurge(originURL.String() + "/page"); n != 1 {
+		t.Fatalf("SoftPurge = %d, want 1", n)
+	}
+	if _, ok := cs.cacheStore.Get(originURL.String() + "/page"); !ok {
+		t.Fatalf("soft purge removed the entry")
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/page", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "body" {
+		t.Fatalf("revalidated response = %d %q", w.Code, w.Body.String())
+	}
+	if got, want := w.Header().Get("Cache-Status"), "kyache; fwd=stale; fwd-status=304"; got != want {
+		t.Errorf("Cache-Status = %q, want %q", got, want)
+	}
+	if notModified.Load() != 1 {
+		t.Errorf("origin answered %d conditional requests, want 1", notModified.Load())
+	}
+
+	// The refreshed entry is fresh again.
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/page", nil))
+	if !strings.Contains(w.Header().Get("Cache-Status"), "hit") || fetches.Load() != 2 {
+		t.Errorf("Cache-Status = %q after %d fetches, want a hit after 2", w.Header().Get("Cache-Status"), fetches.Load())
+	}
+}
+
+func TestStaleIfErrorServesSoftPurgedEntry(t *testing.T) {
+	var failing atomic.Bool
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=600, stale-if-error=60")
+		w.Write([]byte("body"))
+	})
+	cs := New(&Config{})
+	handler := cs.Handler(originURL)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page", nil))
+
+	cs.SoftPurge(originURL.String() + "/page")
+	failing.Store(true)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/page", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "body" {
+		t.Fatalf("response = %d %q, want the stale entry", w.Code, w.Body.String())
+	}
+	if got, want := w.Header().Get("Cache-Status"), "kyache; fwd=stale; fwd-status=503; detail=stale-if-error"; got != want {
+		t.Errorf("Cache-Status = %q, want %q", got, want)
+	}
+}
+
+func TestStaleWhileRevalidateRefreshesInBackground(t *testing.T) {
+	var version atomic.Int32
+	version.Store(1)
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=600, stale-while-revalidate=60")
+		if version.Load() == 1 {
+			w.Write([]byte("v1"))
+		} else {
+			w.Write([]byte("v2"))
+		}
+	})
+	cs := New(&Config{})
+	handler := cs.Handler(originURL)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/page", nil))
+
+	cs.SoftPurge(originURL.String() + "/page")
+	version.Store(2)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/page", nil))
+	if w.Body.String() != "v1" {
+		t.Fatalf("body = %q, want the stale v1", w.Body.String())
+	}
+	if got := w.Header().Get("Cache-Status"); !strings.HasSuffix(got, "detail=stale-while-revalidate") {
+		t.Errorf("Cache-Status = %q", got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cached, ok := cs.cacheStore.Get(originURL.String() + "/page"); ok && string(cached.Body) == "v2" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("entry was not refreshed in the background")
+}
+
+func TestRoundTripRevalidatesStaleEntry(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=600")
+		w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+		if r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body"))
+	})
+	cs := New(&Config{})
+	client := &http.Client{Transport: cs}
+	resp, err := client.Get(originURL.String() + "/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	cs.SoftPurge(originURL.String() + "/page")
+	resp, err = client.Get(originURL.String() + "/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "body" {
+		t.Errorf("response = %d %q", resp.StatusCode, body)
+	}
+	if got, want := resp.Header.Get("Cache-Status"), "kyache; fwd=stale; fwd-status=304"; got != want {
+		t.Errorf("Cache-Status = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,455 @@
+package kyache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+// With Config.SliceSize set, GET requests are served from fixed-size slices
+// of the origin object. Each slice is fetched with a Range request and
+// cached on its own, so a request for part of a large object only fetches
+// the slices it covers. Slice keys include the object's validator, so
+// slices of different versions of an object are never mixed.
+//
+// A metadata entry stored under sliceMetaKey records the object's size and
+// validator along with its response headers; its freshness decides when
+// the object is looked up again.
+
+// unsliceableTTL is how long an object the origin would not serve in
+// slices is fetched whole before slicing it is tried again.
+const unsliceableTTL = 5 * time.Minute
+
+// maxUnsliceable bounds how many objects unsliceable remembers.
+const maxUnsliceable = 10000
+
+// errNoRangeSupport means the origin cannot serve an object in slices: it
+// ignored the Range request or sent no validator to key slices with.
+var errNoRangeSupport = errors.New("origin does not support slicing")
+
+// unsliceable remembers objects the origin would not serve in slices, so
+// requests for them skip slicing instead of sending a Range request the
+// origin is known to refuse.
+type unsliceable struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+func newUnsliceable() *unsliceable {
+	return &unsliceable{until: make(map[string]time.Time)}
+}
+
+func (u *unsliceable) mark(key string) {
+	now := time.Now()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.until) >= maxUnsliceable {
+		for k, t := range u.until {
+			if now.After(t) {
+				delete(u.until, k)
+			}
+		}
+		for k := range u.until {
+			if len(u.until) < maxUnsliceable {
+				break
+			}
+			delete(u.until, k)
+		}
+	}
+	u.until[key] = now.Add(unsliceableTTL)
+}
+
+func (u *unsliceable) has(key string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	t, ok := u.until[key]
+	if ok && time.Now().After(t) {
+		delete(u.until, key)
+		return false
+	}
+	return ok
+}
+
+func sliceMetaKey(key string) string {
+	return key + "#slices"
+}
+
+func sliceKey(key, validator string, index int64) string {
+	sum := sha256.Sum256([]byte(validator))
+	return key + "#slice:" + hex.EncodeToString(sum[:8]) + ":" + strconv.FormatInt(index, 10)
+}
+
+// byteRange is a single range from a Range header. A suffix range asks for
+// the last length bytes; otherwise end is -1 for an open-ended range.
+type byteRange struct {
+	start, end int64
+	suffix     bool
+	length     int64
+}
+
+// parseByteRange parses a Range header holding one byte range. It reports
+// false for anything else, including multiple ranges.
+func parseByteRange(header string) (byteRange, bool) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return byteRange{}, false
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return byteRange{}, false
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return byteRange{}, false
+		}
+		return byteRange{suffix: true, length: n}, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false
+	}
+	end := int64(-1)
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return byteRange{}, false
+		}
+	}
+	return byteRange{start: start, end: end}, true
+}
+
+// resolve returns the inclusive byte offsets the range covers in an object
+// of the given size, or false if it is not satisfiable.
+func (br byteRange) resolve(size int64) (int64, int64, bool) {
+	if br.suffix {
+		if size == 0 {
+			return 0, 0, false
+		}
+		return max(size-br.length, 0), size - 1, true
+	}
+	if br.start >= size {
+		return 0, 0, false
+	}
+	end := br.end
+	if end < 0 || end >= size {
+		end = size - 1
+	}
+	return br.start, end, true
+}
+
+type sliceMeta struct {
+	resp      *cache.CachedResponse
+	size      int64
+	validator string
+}
+
+// responseValidator returns the validator used to key slices: a strong
+// ETag, or Last-Modified when there is none.
+func responseValidator(h http.Header) string {
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return h.Get("Last-Modified")
+}
+
+// parseContentRange parses "bytes first-last/size".
+func parseContentRange(h string) (first, last, size int64, ok bool) {
+	spec, ok := strings.CutPrefix(h, "bytes ")
+	if !ok {
+		return 0, 0, 0, false
+	}
+	if _, err := fmt.Sscanf(spec, "%d-%d/%d", &first, &last, &size); err != nil {
+		return 0, 0, 0, false
+	}
+	return first, last, size, first <= last && last < size
+}
+
+// serveSliced serves r from slices. It returns false without writing
+// anything when the request or the origin is not suitable for slicing, in
+// which case the caller falls back to fetching the whole object.
+func (cs *CacheServer) serveSliced(w http.ResponseWriter, r *http.Request, originURL *url.URL, key string) bool {
+	if cs.unsliceable.has(key) {
+		return false
+	}
+	rng, hasRange := byteRange{start: 0, end: -1}, r.Header.Get("Range") != ""
+	if hasRange {
+		var ok bool
+		if rng, ok = parseByteRange(r.Header.Get("Range")); !ok {
+			return false
+		}
+	}
+
+	reqHeaderStruct := cache.NewParsedHeaders(r.Header)
+	fwd := ""
+	var meta *sliceMeta
+	var first *cache.CachedResponse
+	var firstIndex int64
+	if metaResp, metaFwd := cs.lookup(r.Context(), sliceMetaKey(key), reqHeaderStruct); metaFwd == "" {
+		meta = newSliceMeta(metaResp)
+	} else {
+		// Start with the slice holding the first requested byte so a seek
+		// into a cold object does not fetch the beginning of it.
+		fwd = metaFwd
+		if !rng.suffix {
+			firstIndex = rng.start / cs.sliceSize
+		}
+		var served bool
+		if meta, first, served = cs.fetchFirstSlice(w, r, originURL, key, fwd, metaResp, firstIndex); meta == nil {
+			return served
+		}
+	}
+
+	if hasRange && !ifRangeMatches(r.Header.Get("If-Range"), meta.resp.ResponseHeader) {
+		rng, hasRange = byteRange{start: 0, end: -1}, false
+	}
+
+	start, end, ok := rng.resolve(meta.size)
+	if !ok {
+		w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(meta.size, 10))
+		http.Error(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+
+	firstSlice, lastSlice := start/cs.sliceSize, end/cs.sliceSize
+	if fwd == "" {
+		for i := firstSlice; i <= lastSlice; i++ {
+			if _, ok := cs.cacheStore.Get(sliceKey(key, meta.validator, i)); !ok {
+				fwd = "partial"
+				break
+			}
+		}
+	}
+
+	cs.copyHeadersFromCache(w, meta.resp)
+	h := w.Header()
+	h.Del("Content-Range")
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Age", strconv.Itoa(cache.GetCurrentAge(meta.resp)))
+	h.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	status := http.StatusOK
+	if hasRange {
+		status = http.StatusPartialContent
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, meta.size))
+	}
+	if fwd == "" {
+		cs.countHit(r.Context(), key, reasonFresh, meta.resp, end-start+1)
+		addCacheStatus(h, cacheStatusHit(meta.resp))
+	} else {
+		cs.countMiss(r.Context(), key, fwd, status)
+		addCacheStatus(h, cacheStatusName+"; fwd="+fwd)
+	}
+	w.WriteHeader(status)
+
+	fw := newFlushWriter(w)
+	for i := firstSlice; i <= lastSlice; i++ {
+		var data []byte
+		if first != nil && i == firstIndex {
+			data = first.Body
+		} else {
+			slice, err := cs.getSlice(r, originURL, key, meta, i)
+			if err != nil {
+				// The status line is already out; cutting the body short is
+				// all that is left.
+				cs.countError(r.Context(), key, reasonSlice, err, slog.Int64("slice", i))
+				return true
+			}
+			data = slice.Body
+		}
+		offset := i * cs.sliceSize
+		from, to := max(start-offset, 0), min(end-offset+1, int64(len(data)))
+		if _, err := fw.Write(data[from:to]); err != nil {
+			return true
+		}
+	}
+	return true
+}
+
+func newSliceMeta(resp *cache.CachedResponse) *sliceMeta {
+	size, _ := strconv.ParseInt(resp.ResponseHeader.Get("Content-Length"), 10, 64)
+	return &sliceMeta{resp: resp, size: size, validator: responseValidator(resp.ResponseHeader)}
+}
+
+// ifRangeMatches reports whether an If-Range header lets a Range request
+// be served from an object with header h. An empty If-Range always does.
+// Only strong ETags and exact Last-Modified dates match (RFC 9110 Section
+// 13.1.5).
+func ifRangeMatches(ifRange string, h http.Header) bool {
+	ifRange = strings.TrimSpace(ifRange)
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag := h.Get("ETag")
+		return !strings.HasPrefix(ifRange, "W/") && !strings.HasPrefix(etag, "W/") && ifRange == etag
+	}
+	date, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(h.Get("Last-Modified"))
+	return err == nil && date.Equal(lastModified)
+}
+
+// fetchFirstSlice fetches slice index of an object whose metadata is not
+// cached, and stores both. It returns a nil meta if the origin does not
+// answer with a usable partial response, and remembers the object as
+// unsliceable if the origin cannot slice it. An answer that is neither a
+// slice nor the whole object, such as a 503, is served to w as it is and
+// reported as served. The slices of a stale metadata entry the origin has
+// replaced are evicted.
+func (cs *CacheServer) fetchFirstSlice(w http.ResponseWriter, r *http.Request, originURL *url.URL, key, fwd string, stale *cache.CachedResponse, index int64) (meta *sliceMeta, first *cache.CachedResponse, served bool) {
+	resp, body, err := cs.fetchRange(r, originURL, index)
+	if errors.Is(err, errNoRangeSupport) {
+		cs.unsliceable.mark(key)
+		return nil, nil, false
+	}
+	if err != nil {
+		cs.countError(r.Context(), key, reasonSlice, err, slog.Int64("slice", index))
+		return nil, nil, false
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close()
+		cs.countMiss(r.Context(), key, fwd, resp.StatusCode)
+		addCacheStatus(w.Header(), cacheStatusForward(fwd, resp.StatusCode))
+		cs.copyResponse(w, resp)
+		return nil, nil, true
+	}
+	validator := responseValidator(resp.Header)
+	_, _, size, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if stale != nil {
+		if old := newSliceMeta(stale); old.validator != validator {
+			cs.dropSlices(key, old)
+		}
+	}
+	if validator == "" || !ok {
+		cs.unsliceable.mark(key)
+		return nil, nil, false
+	}
+
+	metaHeader := resp.Header.Clone()
+	metaHeader.Del("Content-Range")
+	metaHeader.Set("Content-Length", strconv.FormatInt(size, 10))
+	metaResp := &cache.CachedResponse{
+		StatusCode:     http.StatusOK,
+		RequestHeader:  r.Header.Clone(),
+		ResponseHeader: metaHeader,
+		StoredAt:       time.Now(),
+		InitialAge:     cache.NewParsedHeaders(resp.Header).GetValidatedAge(),
+		ProtoMajor:     resp.ProtoMajor,
+		ProtoMinor:     resp.ProtoMinor,
+		Proto:          resp.Proto,
+	}
+	meta = &sliceMeta{resp: metaResp, size: size, validator: validator}
+
+	slice := cs.newCachedResponse(r, resp, cache.NewParsedHeaders(resp.Header))
+	slice.Body = body
+	if cache.IsCacheable(http.MethodGet, cache.NewParsedHeaders(metaHeader)) {
+		cs.store(r.Context(), sliceKey(key, validator, index), reasonFill, slice)
+		cs.store(r.Context(), sliceMetaKey(key), reasonFill, metaResp)
+	}
+	return meta, slice, false
+}
+
+// getSlice returns slice index from the cache, fetching it if needed.
+// Concurrent requests for the same slice share one fetch.
+func (cs *CacheServer) getSlice(r *http.Request, originURL *url.URL, key string, meta *sliceMeta, index int64) (*cache.CachedResponse, error) {
+	skey := sliceKey(key, meta.validator, index)
+	if slice, ok := cs.cacheStore.Get(skey); ok {
+		return slice, nil
+	}
+
+	f, leader, res := cs.joinFill(r.Context(), skey)
+	if !leader && res.stored {
+		if slice, ok := cs.cacheStore.Get(skey); ok {
+			return slice, nil
+		}
+	}
+
+	resp, body, err := cs.fetchRange(r, originURL, index)
+	if err == nil && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		err = fmt.Errorf("origin answered a range request with %d", resp.StatusCode)
+	}
+	if err != nil {
+		cs.finishFill(skey, f, false)
+		return nil, err
+	}
+	if validator := responseValidator(resp.Header); validator != meta.validator {
+		// The object changed under us. Drop the metadata so the next
+		// request starts over with the new version.
+		cs.finishFill(skey, f, false)
+		cs.store(r.Context(), sliceMetaKey(key), reasonInvalidate, invalidatedCopy(meta.resp, time.Now()))
+		cs.dropSlices(key, meta)
+		return nil, fmt.Errorf("validator changed from %s to %s", meta.validator, validator)
+	}
+
+	slice := cs.newCachedResponse(r, resp, cache.NewParsedHeaders(resp.Header))
+	slice.Body = body
+	stored := cache.IsCacheable(http.MethodGet, cache.NewParsedHeaders(meta.resp.ResponseHeader))
+	if stored {
+		cs.store(r.Context(), skey, reasonFill, slice)
+	}
+	cs.finishFill(skey, f, stored)
+	return slice, nil
+}
+
+// dropSlices evicts the slices of an object version the origin replaced.
+// Their keys hold the old validator, so nothing would look them up again.
+func (cs *CacheServer) dropSlices(key string, old *sliceMeta) {
+	for i := int64(0); i*cs.sliceSize < old.size; i++ {
+		cs.evict(sliceKey(key, old.validator, i), evictReplaced)
+	}
+}
+
+// fetchRange fetches slice index from the origin and checks that the
+// answer is exactly that slice. A status other than 200 or 206 is returned
+// with its body unread, for the caller to close.
+func (cs *CacheServer) fetchRange(r *http.Request, originURL *url.URL, index int64) (*http.Response, []byte, error) {
+	req := cs.buildOriginRequest(r, originURL)
+	// Conditionals are the client's business with the assembled object,
+	// not with individual slices.
+	for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"} {
+		req.Header.Del(name)
+	}
+	first := index * cs.sliceSize
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", first, first+cs.sliceSize-1))
+
+	resp, err := cs.roundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp.Body = cs.stats.originBody(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+		// An error or a redirect says nothing about range support; hand it
+		// back for the caller to pass on.
+		return resp, nil, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil, nil, fmt.Errorf("%w: it answered a range request with %d", errNoRangeSupport, resp.StatusCode)
+	}
+	gotFirst, gotLast, _, ok := parseContentRange(resp.Header.Get("Content-Range"))
+	if !ok || gotFirst != first {
+		return nil, nil, fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range"))
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, cs.sliceSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(body)) != gotLast-gotFirst+1 {
+		return nil, nil, fmt.Errorf("slice body has %d bytes, Content-Range says %d", len(body), gotLast-gotFirst+1)
+	}
+	return resp, body, nil
+}
@@ -0,0 +1,266 @@
+package kyache
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		size       int64
+		start, end int64
+		ok         bool
+	}{
+		{"bytes=0-3", 10, 0, 3, true},
+		{"bytes=5-", 10, 5, 9, true},
+		{"bytes=-4", 10, 6, 9, true},
+		{"bytes=8-20", 10, 8, 9, true},
+		{"bytes=-20", 10, 0, 9, true},
+		{"bytes=10-", 10, 0, 0, false},
+		{"bytes=0-1,4-5", 10, 0, 0, false},
+		{"bytes=5-2", 10, 0, 0, false},
+		{"items=0-1", 10, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			rng, ok := parseByteRange(tt.header)
+			var start, end int64
+			if ok {
+				start, end, ok = rng.resolve(tt.size)
+			}
+			if ok != tt.ok || start != tt.start || end != tt.end {
+				t.Errorf("got %d-%d %v, want %d-%d %v", start, end, ok, tt.start, tt.end, tt.ok)
+			}
+		})
+	}
+}
+
+// newRangeOrigin serves content with range support and records the Range
+// header of each request it receives.
+func newRangeOrigin(t *testing.T, content string) (*url.URL, func() []string) {
+	var mu sync.Mutex
+	var ranges []string
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	})
+	return originURL, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(ranges)
+	}
+}
+
+func TestSlicedRangeFetchesOnlyCoveringSlices(t *testing.T) {
+	originURL, originRanges := newRangeOrigin(t, "abcdefghijklmnop")
+	handler := New(&Config{SliceSize: 4}).Handler(originURL)
+
+	req := httptest.NewRequest("GET", "/movie", nil)
+	req.Header.Set("Range", "bytes=5-9")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusPartialContent || w.Body.String() != "fghij" {
+		t.Fatalf("response = %d %q, want 206 %q", w.Code, w.Body.String(), "fghij")
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 5-9/16" {
+		t.Errorf("Content-Range = %q, want %q", got, "bytes 5-9/16")
+	}
+	if got, want := originRanges(), []string{"bytes=4-7", "bytes=8-11"}; !slices.Equal(got, want) {
+		t.Errorf("origin ranges = %v, want %v", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/movie", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "abcdefghijklmnop" {
+		t.Fatalf("full response = %d %q", w.Code, w.Body.String())
+	}
+	if got, want := originRanges()[2:], []string{"bytes=0-3", "bytes=12-15"}; !slices.Equal(got, want) {
+		t.Errorf("origin ranges for the rest = %v, want %v", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/movie", nil))
+	if !strings.Contains(w.Header().Get("Cache-Status"), "hit") {
+		t.Errorf("Cache-Status = %q, want a hit", w.Header().Get("Cache-Status"))
+	}
+	if got := len(originRanges()); got != 4 {
+		t.Errorf("origin requests = %d, want 4", got)
+	}
+}
+
+func TestSlicingFallsBackWithoutRangeSupport(t *testing.T) {
+	for _, cacheControl := range []string{"max-age=60", "no-store"} {
+		t.Run(cacheControl, func(t *testing.T) {
+			var mu sync.Mutex
+			requests := 0
+			originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requests++
+				mu.Unlock()
+				w.Header().Set("Cache-Control", cacheControl)
+				w.Write([]byte("no ranges here"))
+			})
+			var logs bytes.Buffer
+			handler := New(&Config{SliceSize: 4, Logger: slog.New(slog.NewJSONHandler(&logs, nil))}).Handler(originURL)
+
+			for range 3 {
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", "/plain", nil))
+				if w.Code != http.StatusOK || w.Body.String() != "no ranges here" {
+					t.Fatalf("response = %d %q", w.Code, w.Body.String())
+				}
+			}
+			// The first request tries a slice, then fetches the object
+			// whole. Later ones skip slicing: a cacheable object is served
+			// from the cache and an uncacheable one is fetched whole.
+			want := 2
+			if cacheControl == "no-store" {
+				want = 4
+			}
+			if requests != want {
+				t.Errorf("origin requests = %d, want %d", requests, want)
+			}
+			if logs.Len() != 0 {
+				t.Errorf("logged %s", logs.String())
+			}
+		})
+	}
+}
+
+func TestSlicingPassesOnOriginErrors(t *testing.T) {
+	var mu sync.Mutex
+	var ranges []string
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		first := len(ranges) == 1
+		mu.Unlock()
+		if first {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("abcdefgh"))
+	})
+	handler := New(&Config{SliceSize: 4}).Handler(originURL)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/movie", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "try again\n" {
+		t.Fatalf("first response = %d %q, want the origin's 503", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("Cache-Status"); !strings.Contains(got, "fwd-status=503") {
+		t.Errorf("Cache-Status = %q, want fwd-status=503", got)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/movie", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "abcdefgh" {
+		t.Fatalf("second response = %d %q", w.Code, w.Body.String())
+	}
+	// The 503 is neither fetched again whole nor taken as a lack of range
+	// support, so the object is still sliced.
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"bytes=0-3", "bytes=0-3", "bytes=4-7"}; !slices.Equal(ranges, want) {
+		t.Errorf("origin ranges = %v, want %v", ranges, want)
+	}
+}
+
+func TestSlicedIfRange(t *testing.T) {
+	originURL, _ := newRangeOrigin(t, "abcdefghijklmnop")
+	handler := New(&Config{SliceSize: 4}).Handler(originURL)
+
+	for _, tt := range []struct {
+		ifRange string
+		status  int
+		body    string
+	}{
+		{`"v1"`, http.StatusPartialContent, "fghij"},
+		{`"v0"`, http.StatusOK, "abcdefghijklmnop"},
+		{`W/"v1"`, http.StatusOK, "abcdefghijklmnop"},
+	} {
+		req := httptest.NewRequest("GET", "/movie", nil)
+		req.Header.Set("Range", "bytes=5-9")
+		req.Header.Set("If-Range", tt.ifRange)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tt.status || w.Body.String() != tt.body {
+			t.Errorf("If-Range %s: response = %d %q, want %d %q", tt.ifRange, w.Code, w.Body.String(), tt.status, tt.body)
+		}
+	}
+}
+
+func TestSlicedValidatorChangeIsStored(t *testing.T) {
+	var mu sync.Mutex
+	etag := `"v1"`
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("abcdefgh"))
+	})
+	o := &recordingObserver{}
+	handler := New(&Config{SliceSize: 4, Observer: o}).Handler(originURL)
+
+	req := httptest.NewRequest("GET", "/movie", nil)
+	req.Header.Set("Range", "bytes=0-1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	mu.Lock()
+	etag = `"v2"`
+	mu.Unlock()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/movie", nil))
+
+	if !slices.Contains(o.events, "store invalidate 200") {
+		t.Errorf("events = %q, want the metadata invalidation stored", o.events)
+	}
+	if !slices.Contains(o.events, "evict replaced 0") {
+		t.Errorf("events = %q, want the v1 slice evicted", o.events)
+	}
+}
+
+func TestStaleSliceMetaEvictsReplacedSlices(t *testing.T) {
+	var mu sync.Mutex
+	etag := `"v1"`
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", etag)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("abcdefgh"))
+	})
+	cs := New(&Config{SliceSize: 4})
+	handler := cs.Handler(originURL)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/movie", nil))
+	if got := cs.Stats().Entries; got != 3 {
+		t.Fatalf("entries = %d, want the metadata and two slices", got)
+	}
+	mu.Lock()
+	etag = `"v2"`
+	mu.Unlock()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/movie", nil))
+	if w.Body.String() != "abcdefgh" {
+		t.Fatalf("body = %q", w.Body.String())
+	}
+	if got := cs.Stats().Entries; got != 3 {
+		t.Errorf("entries = %d, want only the metadata and slices of v2", got)
+	}
+}
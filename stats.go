@@ -0,0 +1,329 @@
+package kyache
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kota-yata/kyache/cache"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+// cacheStats counts what happened to the requests handled by a
+// CacheServer. Every GET the cache could answer ends in exactly one of
+// hits, stale, revalidated or misses; other methods are bypasses.
+// Revalidations count conditional origin requests, including background
+// ones, by whether the stored response was still valid.
+type cacheStats struct {
+	hits        atomic.Int64
+	stale       atomic.Int64
+	revalidated atomic.Int64
+	misses      atomic.Int64
+	bypasses    atomic.Int64
+
+	notModified  atomic.Int64
+	modified     atomic.Int64
+	originErrors atomic.Int64
+
+	cacheBytes  atomic.Int64
+	originBytes atomic.Int64
+}
+
+// hit counts a fresh hit serving n body bytes. Hits on an in-progress
+// fill pass zero and count their bytes as they are delivered, through
+// cacheBody or cacheBytes.
+func (st *cacheStats) hit(n int64) {
+	st.hits.Add(1)
+	st.cacheBytes.Add(n)
+}
+
+func (st *cacheStats) staleServe(n int64) {
+	st.stale.Add(1)
+	st.cacheBytes.Add(n)
+}
+
+// revalidatedServe counts a stored body served after a 304.
+func (st *cacheStats) revalidatedServe(n int64) {
+	st.revalidated.Add(1)
+	st.cacheBytes.Add(n)
+}
+
+// miss counts a request answered by the origin. Its bytes are counted as
+// the body is delivered, through originBody or originBytes.
+func (st *cacheStats) miss() {
+	st.misses.Add(1)
+}
+
+func (st *cacheStats) revalidation(notModified bool) {
+	if notModified {
+		st.notModified.Add(1)
+	} else {
+		st.modified.Add(1)
+	}
+}
+
+// originResult counts an origin response, or the failure to get one, as an
+// origin error if there was no response or a server error.
+func (st *cacheStats) originResult(resp *http.Response, err error) {
+	if err != nil || resp.StatusCode >= 500 {
+		st.originErrors.Add(1)
+	}
+}
+
+// originBody and cacheBody count the bytes read from body.
+func (st *cacheStats) originBody(body io.ReadCloser) io.ReadCloser {
+	return &countingBody{ReadCloser: body, n: &st.originBytes}
+}
+
+func (st *cacheStats) cacheBody(body io.ReadCloser) io.ReadCloser {
+	return &countingBody{ReadCloser: body, n: &st.cacheBytes}
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (cb *countingBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	cb.n.Add(int64(n))
+	return n, err
+}
+
+// The count functions record what happened to a request in the
+// statistics and the metrics, tell the observer and log it.
+
+// countHit records a response served from the entry under key. n is the
+// number of body bytes served; see cacheStats.hit.
+func (cs *CacheServer) countHit(ctx context.Context, key, reason string, resp *cache.CachedResponse, n int64) {
+	cs.stats.hit(n)
+	cs.metrics.hit(entryHost(key), resp.StatusCode)
+	setResult(ctx, resultHit)
+	cs.observeHit(ctx, key, reason, resp)
+}
+
+func (cs *CacheServer) countStale(ctx context.Context, key, reason string, resp *cache.CachedResponse) {
+	cs.stats.staleServe(int64(len(resp.Body)))
+	cs.metrics.hit(entryHost(key), resp.StatusCode)
+	setResult(ctx, resultStale)
+	cs.observeHit(ctx, key, reason, resp)
+}
+
+// countRevalidated records a stored response served after a 304.
+func (cs *CacheServer) countRevalidated(ctx context.Context, key string, resp *cache.CachedResponse) {
+	cs.stats.revalidatedServe(int64(len(resp.Body)))
+	cs.metrics.hit(entryHost(key), resp.StatusCode)
+	setResult(ctx, resultRevalidated)
+	cs.observeHit(ctx, key, reasonRevalidated, resp)
+}
+
+func (cs *CacheServer) observeHit(ctx context.Context, key, reason string, resp *cache.CachedResponse) {
+	e := event(ctx, key, reason)
+	e.Status = resp.StatusCode
+	e.Response = resp
+	cs.notify(ctx, eventHit, e)
+}
+
+// countMiss records a response for key served from the origin, with status
+// zero if the origin could not be reached. reason is the fwd parameter of
+// the Cache-Status header.
+func (cs *CacheServer) countMiss(ctx context.Context, key, reason string, status int) {
+	if reason == fwdMethod {
+		cs.stats.bypasses.Add(1)
+		setResult(ctx, resultBypass)
+	} else {
+		cs.stats.miss()
+		cs.metrics.miss(entryHost(key), status)
+		setResult(ctx, resultMiss)
+	}
+	e := event(ctx, key, reason)
+	e.Status = status
+	cs.notify(ctx, eventMiss, e)
+}
+
+// countRevalidation records the origin's answer to a conditional request
+// for the stale entry under key.
+func (cs *CacheServer) countRevalidation(ctx context.Context, key string, stale *cache.CachedResponse, status int) {
+	reason := reasonModified
+	if status == http.StatusNotModified {
+		reason = reasonNotModified
+	}
+	cs.stats.revalidation(status == http.StatusNotModified)
+	e := event(ctx, key, reason)
+	e.Status = status
+	e.Response = stale
+	cs.notify(ctx, eventRevalidate, e)
+}
+
+// countError records and logs a failed origin fetch for key. attrs add
+// detail to the log record.
+func (cs *CacheServer) countError(ctx context.Context, key, reason string, err error, attrs ...slog.Attr) {
+	e := event(ctx, key, reason)
+	e.Err = err
+	cs.notify(ctx, eventError, e)
+	cs.logOriginError(ctx, e, attrs...)
+}
+
+// store writes entry under key. reason is reasonFill or reasonRefresh.
+// Entries a ban added since their headers arrived are dropped.
+func (cs *CacheServer) store(ctx context.Context, key, reason string, entry *cache.CachedResponse) {
+	if cs.bans.refuses(key, entry) {
+		return
+	}
+	_, span := cs.startSpan(ctx, spanStore)
+	span.set("cache.key", key)
+	span.set("cache.store_reason", reason)
+	span.set("cache.entry.size", cache.EntrySize(entry))
+	cs.cacheStore.Set(key, entry)
+	span.end()
+	cs.metrics.store(entryHost(key), entry.StatusCode)
+	e := event(ctx, key, reason)
+	e.Status = entry.StatusCode
+	e.Response = entry
+	cs.notify(ctx, eventStore, e)
+}
+
+// evict deletes key and reports whether it was present, counting it as
+// evicted for reason.
+func (cs *CacheServer) evict(key, reason string) bool {
+	if !cs.cacheStore.Delete(key) {
+		return false
+	}
+	cs.countEviction(key, reason)
+	return true
+}
+
+// evicted is called by stores that evict key on their own.
+func (cs *CacheServer) evicted(key string) {
+	cs.indexed.forget(key)
+	cs.countEviction(key, evictCapacity)
+}
+
+func (cs *CacheServer) countEviction(key, reason string) {
+	cs.metrics.evict(entryHost(key), reason)
+	cs.notify(context.Background(), eventEvict, Event{Key: key, Reason: reason})
+}
+
+// roundTrip sends req to the origin, recording how long the response took
+// to arrive and, once it has been read, how large its body was.
+func (cs *CacheServer) roundTrip(req *http.Request) (*http.Response, error) {
+	host := strings.ToLower(req.URL.Host)
+	ctx, span := cs.startSpan(req.Context(), spanOriginFetch)
+	if span != nil {
+		// The span is the parent of the origin's work. Clone so the
+		// caller's request keeps its own trace headers.
+		req = req.Clone(traceOrigin(ctx, span))
+		span.tc.inject(req.Header)
+		span.set("server.address", host)
+	}
+	start := time.Now()
+	resp, err := cs.transport.RoundTrip(req)
+	latency := time.Since(start)
+	cs.metrics.originFetch(host, latency)
+	cs.stats.originResult(resp, err)
+	ex := exchangeFrom(req.Context())
+	if ex != nil {
+		ex.originLatency = latency
+	}
+	if err != nil {
+		span.set("error", err.Error())
+		span.end()
+		return nil, err
+	}
+	if ex != nil {
+		ex.originStatus = resp.StatusCode
+	}
+	span.set("http.response.status_code", resp.StatusCode)
+	resp.Body = &sizeBody{ReadCloser: resp.Body, done: func(n int64) {
+		cs.metrics.originResponseSize(host, n)
+		span.set("http.response.body.size", n)
+		span.end()
+	}}
+	return resp, nil
+}
+
+// Stats is a snapshot of a CacheServer's counters, as served by /statusz.
+type Stats struct {
+	Uptime    float64 `json:"uptime_seconds"`
+	Transport string  `json:"transport"`
+	// Entries and Bytes are -1 when the store cannot report them.
+	Entries int   `json:"entries"`
+	Bytes   int64 `json:"bytes"`
+
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	Stale       int64 `json:"stale"`
+	Revalidated int64 `json:"revalidated"`
+	Bypasses    int64 `json:"bypasses"`
+
+	RevalidationsNotModified int64 `json:"revalidations_304"`
+	RevalidationsModified    int64 `json:"revalidations_200"`
+	OriginErrors             int64 `json:"origin_errors"`
+
+	// HitRatio is the share of GET requests answered from the cache,
+	// counting stale and revalidated responses. ByteHitRatio is the share
+	// of body bytes served from the cache rather than the origin.
+	HitRatio     float64 `json:"hit_ratio"`
+	ByteHitRatio float64 `json:"byte_hit_ratio"`
+}
+
+// Stats returns the current counters.
+func (cs *CacheServer) Stats() Stats {
+	st := &cs.stats
+	s := Stats{
+		Uptime:    time.Since(cs.startedAt).Seconds(),
+		Transport: transportName(cs.transport),
+		Entries:   -1,
+		Bytes:     -1,
+
+		Hits:        st.hits.Load(),
+		Misses:      st.misses.Load(),
+		Stale:       st.stale.Load(),
+		Revalidated: st.revalidated.Load(),
+		Bypasses:    st.bypasses.Load(),
+
+		RevalidationsNotModified: st.notModified.Load(),
+		RevalidationsModified:    st.modified.Load(),
+		OriginErrors:             st.originErrors.Load(),
+	}
+	if sizer, ok := cs.indexed.Store.(cache.Sizer); ok {
+		s.Entries = sizer.Len()
+		s.Bytes = sizer.Size()
+	}
+	fromCache := s.Hits + s.Stale + s.Revalidated
+	s.HitRatio = ratio(fromCache, fromCache+s.Misses)
+	cacheBytes := st.cacheBytes.Load()
+	s.ByteHitRatio = ratio(cacheBytes, cacheBytes+st.originBytes.Load())
+	return s
+}
+
+func ratio(part, whole int64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return float64(part) / float64(whole)
+}
+
+// transportName names the protocol the origin transport speaks. An
+// *http.Transport that attempts HTTP/2, like http.DefaultTransport, only
+// uses it when a TLS origin offers it, and HTTP/1.1 otherwise.
+func transportName(rt http.RoundTripper) string {
+	switch t := rt.(type) {
+	case *http3.Transport:
+		return "HTTP/3"
+	case *http2.Transport:
+		return "HTTP/2"
+	case *http.Transport:
+		if t.ForceAttemptHTTP2 {
+			return "HTTP/1.1 (HTTP/2 over TLS)"
+		}
+		return "HTTP/1.1"
+	default:
+		return "custom"
+	}
+}
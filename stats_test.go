@@ -0,0 +1,85 @@
+package kyache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+)
+
+func TestStatsCountHitsAndMisses(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/private" {
+			w.Header().Set("Cache-Control", "no-store")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		w.Write([]byte("0123456789"))
+	})
+	cs := New(&Config{})
+	handler := cs.Handler(originURL)
+
+	for _, path := range []string{"/a", "/a", "/a", "/private"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/a", nil))
+
+	s := cs.Stats()
+	if s.Hits != 2 || s.Misses != 2 || s.Bypasses != 1 {
+		t.Errorf("hits/misses/bypasses = %d/%d/%d, want 2/2/1", s.Hits, s.Misses, s.Bypasses)
+	}
+	if s.HitRatio != 0.5 {
+		t.Errorf("hit ratio = %v, want 0.5", s.HitRatio)
+	}
+	// 20 bytes came from the cache and 30 from the origin: two misses and
+	// the bypassed POST.
+	if s.ByteHitRatio != 0.4 {
+		t.Errorf("byte hit ratio = %v, want 0.4", s.ByteHitRatio)
+	}
+	if s.Entries != 1 || s.Bytes <= 10 {
+		t.Errorf("entries = %d with %d bytes, want 1 with more than 10", s.Entries, s.Bytes)
+	}
+}
+
+func TestStatsCountRevalidations(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("body"))
+	})
+	cs := New(&Config{})
+	handler := cs.Handler(originURL)
+
+	for range 2 {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/r", nil))
+	}
+
+	s := cs.Stats()
+	if s.Misses != 1 || s.Revalidated != 1 || s.RevalidationsNotModified != 1 {
+		t.Errorf("misses/revalidated/304s = %d/%d/%d, want 1/1/1", s.Misses, s.Revalidated, s.RevalidationsNotModified)
+	}
+}
+
+func TestTransportName(t *testing.T) {
+	tests := []struct {
+		rt   http.RoundTripper
+		want string
+	}{
+		{&http.Transport{}, "HTTP/1.1"},
+		{&http.Transport{ForceAttemptHTTP2: true}, "HTTP/1.1 (HTTP/2 over TLS)"},
+		{&http2.Transport{}, "HTTP/2"},
+		{&http3.Transport{}, "HTTP/3"},
+		{New(&Config{}), "custom"},
+	}
+	for _, tt := range tests {
+		if got := transportName(tt.rt); got != tt.want {
+			t.Errorf("transportName(%T) = %q, want %q", tt.rt, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package kyache
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+// DefaultMaxObjectSize is used when Config.MaxObjectSize is zero.
+const DefaultMaxObjectSize = 64 << 20
+
+// fillBuffer collects a response body for the cache while the body is being
+// streamed to the client. The body is kept in a cache.ChunkedBody so
+// collapsed requests can follow it as it arrives. Once the body outgrows
+// limit it is dropped and later writes are discarded, so large objects
+// pass through without being held in memory.
+type fillBuffer struct {
+	body     *cache.ChunkedBody
+	limit    int64
+	overflow bool
+}
+
+func (cs *CacheServer) newFillBuffer(resp *http.Response) *fillBuffer {
+	fb := &fillBuffer{body: cache.NewChunkedBody(), limit: cs.maxObjectSize}
+	if fb.limit >= 0 && resp.ContentLength > fb.limit {
+		fb.abandon()
+	}
+	return fb
+}
+
+func (fb *fillBuffer) Write(p []byte) (int, error) {
+	if fb.overflow {
+		return len(p), nil
+	}
+	if fb.limit >= 0 && fb.body.Len()+int64(len(p)) > fb.limit {
+		fb.abandon()
+		return len(p), nil
+	}
+	return fb.body.Write(p)
+}
+
+// abandon gives up on storing the body and frees what was buffered.
+func (fb *fillBuffer) abandon() {
+	fb.overflow = true
+	fb.body.Discard(nil)
+}
+
+// attachable reports whether other requests may follow the body while it
+// is filled. That needs a declared length within the size limit, so the
+// fill cannot be abandoned for being too large after they have started.
+func (fb *fillBuffer) attachable(resp *http.Response) bool {
+	if fb.overflow {
+		return false
+	}
+	return fb.limit < 0 || resp.ContentLength >= 0
+}
+
+// complete reports whether the buffered body can be stored: it must fit the
+// size limit and match the declared Content-Length, if any.
+func (fb *fillBuffer) complete(resp *http.Response) bool {
+	if fb.overflow {
+		return false
+	}
+	return resp.ContentLength < 0 || fb.body.Len() == resp.ContentLength
+}
+
+// end closes the body for readers following it, and reports whether it is
+// complete.
+func (fb *fillBuffer) end(resp *http.Response) bool {
+	if !fb.complete(resp) {
+		fb.body.Abort(nil)
+		return false
+	}
+	fb.body.Close()
+	return true
+}
+
+// flushWriter flushes after every write so streamed bodies reach the client
+// as they arrive instead of waiting for the server's write buffer to fill.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func newFlushWriter(w http.ResponseWriter) *flushWriter {
+	return &flushWriter{w: w, rc: http.NewResponseController(w)}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if err := fw.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+	return n, nil
+}
+
+// clientWriter remembers a failed write to the client, so a copy error can
+// be told apart from a failed read from the origin.
+type clientWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (cw *clientWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if err != nil {
+		cw.err = err
+	}
+	return n, err
+}
+
+// teeBody wraps an origin response body for RoundTrip callers. The body is
+// copied into a fillBuffer as the caller reads it and stored once the caller
+// reaches EOF. Bodies that are closed early or fail mid-way are discarded.
+type teeBody struct {
+	body   io.ReadCloser
+	resp   *http.Response
+	fill   *fillBuffer
+	store  func(body []byte)
+	finish func(stored bool)
+	done   bool
+}
+
+func (tb *teeBody) Read(p []byte) (int, error) {
+	n, err := tb.body.Read(p)
+	if tb.done {
+		return n, err
+	}
+	tb.fill.Write(p[:n])
+	if err == io.EOF {
+		stored := tb.fill.end(tb.resp)
+		if stored {
+			tb.store(tb.fill.body.Bytes())
+		}
+		tb.end(stored)
+	} else if err != nil {
+		tb.fill.body.Abort(err)
+		tb.end(false)
+	}
+	return n, err
+}
+
+func (tb *teeBody) Close() error {
+	if !tb.done {
+		tb.fill.body.Abort(nil)
+		tb.end(false)
+	}
+	return tb.body.Close()
+}
+
+func (tb *teeBody) end(stored bool) {
+	tb.done = true
+	tb.fill = nil
+	if tb.finish != nil {
+		tb.finish(stored)
+	}
+}
@@ -0,0 +1,43 @@
+package kyache
+
+import "sync"
+
+// sweeper runs pass in the background on demand. Requests made while a
+// pass runs are folded into one more pass after it.
+type sweeper struct {
+	pass func()
+
+	mu      sync.Mutex
+	running bool
+	dirty   bool
+}
+
+func newSweeper(pass func()) *sweeper {
+	return &sweeper{pass: pass}
+}
+
+func (s *sweeper) trigger() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		s.dirty = true
+		return
+	}
+	s.running = true
+	go s.run()
+}
+
+func (s *sweeper) run() {
+	for {
+		s.pass()
+
+		s.mu.Lock()
+		if !s.dirty {
+			s.running = false
+			s.mu.Unlock()
+			return
+		}
+		s.dirty = false
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,132 @@
+package kyache
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// tagHeaders carry the surrogate keys an origin tags a response with, as
+// space-separated values. Commas are accepted as separators as well.
+var tagHeaders = []string{"Surrogate-Key", "Cache-Tag"}
+
+func isTagHeader(name string) bool {
+	for _, h := range tagHeaders {
+		if name == h {
+			return true
+		}
+	}
+	return false
+}
+
+// responseTags returns the distinct tags listed in h.
+func responseTags(h http.Header) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, name := range tagHeaders {
+		for _, v := range h.Values(name) {
+			for _, tag := range strings.FieldsFunc(v, func(r rune) bool {
+				return r == ' ' || r == '\t' || r == ','
+			}) {
+				if !seen[tag] {
+					seen[tag] = true
+					tags = append(tags, tag)
+				}
+			}
+		}
+	}
+	return tags
+}
+
+// entryLabels returns what the entry stored under key is indexed by: its
+// tags and its cache groups.
+func entryLabels(key string, h http.Header) []string {
+	return append(responseTags(h), groupLabels(key, h)...)
+}
+
+// tagIndex maps labels, that is tags or cache group labels, to the keys of
+// the entries carrying them.
+type tagIndex struct {
+	mu   sync.Mutex
+	keys map[string]map[string]struct{}
+	tags map[string][]string
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		keys: make(map[string]map[string]struct{}),
+		tags: make(map[string][]string),
+	}
+}
+
+// set replaces the tags recorded for key.
+func (ti *tagIndex) set(key string, tags []string) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.removeLocked(key)
+	if len(tags) == 0 {
+		return
+	}
+	ti.tags[key] = tags
+	for _, tag := range tags {
+		keys := ti.keys[tag]
+		if keys == nil {
+			keys = make(map[string]struct{})
+			ti.keys[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+}
+
+func (ti *tagIndex) remove(key string) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.removeLocked(key)
+}
+
+func (ti *tagIndex) removeLocked(key string) {
+	for _, tag := range ti.tags[key] {
+		delete(ti.keys[tag], key)
+		if len(ti.keys[tag]) == 0 {
+			delete(ti.keys, tag)
+		}
+	}
+	delete(ti.tags, key)
+}
+
+func (ti *tagIndex) lookup(tag string) []string {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	keys := make([]string, 0, len(ti.keys[tag]))
+	for key := range ti.keys[tag] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// PurgeTag removes every stored response tagged with tag in its
+// Surrogate-Key or Cache-Tag header, and returns how many were removed.
+func (cs *CacheServer) PurgeTag(tag string) int {
+	cs.indexed.load()
+	return cs.purgeKeys(cs.indexed.index.lookup(tag), false)
+}
+
+// SoftPurgeTag is the soft variant of PurgeTag.
+func (cs *CacheServer) SoftPurgeTag(tag string) int {
+	cs.indexed.load()
+	return cs.purgeKeys(cs.indexed.index.lookup(tag), true)
+}
+
+// hidesHeader reports whether a response header is kept from clients.
+func (cs *CacheServer) hidesHeader(name string) bool {
+	return cs.stripTagHeaders && isTagHeader(name)
+}
+
+func (cs *CacheServer) removeHiddenHeaders(h http.Header) {
+	if !cs.stripTagHeaders {
+		return
+	}
+	for _, name := range tagHeaders {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,84 @@
+package kyache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/kota-yata/kyache/cache"
+)
+
+func TestResponseTags(t *testing.T) {
+	h := http.Header{}
+	h.Set("Surrogate-Key", "product-1  category-2")
+	h.Set("Cache-Tag", "product-1,home")
+	want := []string{"product-1", "category-2", "home"}
+	if got := responseTags(h); !reflect.DeepEqual(got, want) {
+		t.Errorf("responseTags = %q, want %q", got, want)
+	}
+}
+
+func TestPurgeTag(t *testing.T) {
+	cs := New(&Config{})
+	for key, tags := range map[string]string{
+		"http://example.com/p/1":   "product-1 home",
+		"http://example.com/":      "home",
+		"http://example.com/about": "",
+	} {
+		cs.cacheStore.Set(key, &cache.CachedResponse{
+			StatusCode:     http.StatusOK,
+			RequestHeader:  http.Header{},
+			ResponseHeader: http.Header{"Surrogate-Key": []string{tags}},
+		})
+	}
+
+	if n := cs.PurgeTag("home"); n != 2 {
+		t.Errorf("PurgeTag = %d, want 2", n)
+	}
+	if _, ok := cs.cacheStore.Get("http://example.com/about"); !ok {
+		t.Errorf("untagged entry was purged")
+	}
+	// The purged entries left the index along with the store.
+	if n := cs.PurgeTag("product-1"); n != 0 {
+		t.Errorf("PurgeTag after purge = %d, want 0", n)
+	}
+}
+
+func TestPurgeTagIndexesExistingEntries(t *testing.T) {
+	store := cache.NewCacheStore()
+	store.Set("http://example.com/a", &cache.CachedResponse{
+		StatusCode:     http.StatusOK,
+		RequestHeader:  http.Header{},
+		ResponseHeader: http.Header{"Cache-Tag": []string{"a"}},
+	})
+	cs := New(&Config{Store: store})
+	if n := cs.PurgeTag("a"); n != 1 {
+		t.Errorf("PurgeTag = %d, want 1", n)
+	}
+}
+
+func TestStripTagHeaders(t *testing.T) {
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Surrogate-Key", "secret-tag")
+		w.Write([]byte("body"))
+	})
+	cs := New(&Config{StripTagHeaders: true, EnableAdmin: true})
+	handler := cs.Handler(originURL)
+
+	for i, want := range []string{"miss", "hit"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/tagged", nil))
+		if got := w.Header().Get("Surrogate-Key"); got != "" {
+			t.Errorf("request %d (%s): Surrogate-Key = %q reached the client", i, want, got)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/purge?tag="+url.QueryEscape("secret-tag"), nil))
+	if w.Body.String() != `{"purged":1}` {
+		t.Errorf("purge by tag = %q", w.Body.String())
+	}
+}
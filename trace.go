@@ -0,0 +1,265 @@
+package kyache
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names of the spans kyache records.
+const (
+	spanRequest     = "kyache.request"
+	spanLookup      = "kyache.lookup"
+	spanOriginFetch = "kyache.origin_fetch"
+	spanStore       = "kyache.store"
+)
+
+// W3C Trace Context headers.
+const (
+	headerTraceparent = "Traceparent"
+	headerTracestate  = "Tracestate"
+)
+
+// Span is a finished unit of work in a trace, such as a cache lookup or an
+// origin fetch. IDs are hex encoded as in the traceparent header.
+type Span struct {
+	TraceID    string         `json:"trace_id"`
+	SpanID     string         `json:"span_id"`
+	ParentID   string         `json:"parent_id,omitempty"`
+	Name       string         `json:"name"`
+	Start      time.Time      `json:"start"`
+	End        time.Time      `json:"end"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+	// Events are points in time within the span, such as "dns_done" or
+	// "first_byte" for an origin fetch.
+	Events []SpanEvent `json:"events,omitempty"`
+}
+
+type SpanEvent struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+// SpanExporter receives spans as they end. It is called synchronously from
+// the request path, so it should hand spans off rather than block on them.
+type SpanExporter interface {
+	ExportSpan(Span)
+}
+
+// JSONSpanExporter writes each span as a line of JSON. It is safe for
+// concurrent use.
+type JSONSpanExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONSpanExporter writes spans to w, such as os.Stdout.
+func NewJSONSpanExporter(w io.Writer) *JSONSpanExporter {
+	return &JSONSpanExporter{w: w}
+}
+
+func (e *JSONSpanExporter) ExportSpan(s Span) {
+	line, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Write(append(line, '\n'))
+}
+
+// traceContext identifies a span across processes, as carried by the
+// traceparent and tracestate headers.
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+	state   string
+}
+
+// parseTraceparent parses a version 00 traceparent header, or any later
+// version as far as version 00 defines it.
+func parseTraceparent(h http.Header) (traceContext, bool) {
+	var tc traceContext
+	v := strings.TrimSpace(h.Get(headerTraceparent))
+	if len(v) < 55 || (len(v) > 55 && (v[:2] == "00" || v[55] != '-')) {
+		return tc, false
+	}
+	if v[2] != '-' || v[35] != '-' || v[52] != '-' || v[:2] == "ff" {
+		return tc, false
+	}
+	var version, flags [1]byte
+	if _, err := hex.Decode(version[:], []byte(v[:2])); err != nil {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.traceID[:], []byte(v[3:35])); err != nil || tc.traceID == [16]byte{} {
+		return tc, false
+	}
+	if _, err := hex.Decode(tc.spanID[:], []byte(v[36:52])); err != nil || tc.spanID == [8]byte{} {
+		return tc, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(v[53:55])); err != nil {
+		return tc, false
+	}
+	tc.sampled = flags[0]&1 == 1
+	tc.state = strings.Join(h.Values(headerTracestate), ",")
+	return tc, true
+}
+
+func (tc traceContext) traceparent() string {
+	flags := "00"
+	if tc.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(tc.traceID[:]) + "-" + hex.EncodeToString(tc.spanID[:]) + "-" + flags
+}
+
+// inject sets the trace headers of an outgoing request to tc.
+func (tc traceContext) inject(h http.Header) {
+	h.Set(headerTraceparent, tc.traceparent())
+	h.Del(headerTracestate)
+	if tc.state != "" {
+		h.Set(headerTracestate, tc.state)
+	}
+}
+
+// span is a span in progress. A nil span records nothing, so callers need
+// not check whether tracing is enabled.
+type span struct {
+	exporter SpanExporter
+	tc       traceContext
+
+	mu    sync.Mutex
+	data  Span
+	ended bool
+}
+
+type spanKey struct{}
+
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startRequestSpan starts the span of a request kyache serves, continuing
+// the trace of header's traceparent if it has a valid one.
+func (cs *CacheServer) startRequestSpan(ctx context.Context, r *http.Request) (context.Context, *span) {
+	if cs.spanExporter == nil {
+		return ctx, nil
+	}
+	parent, ok := parseTraceparent(r.Header)
+	if !ok {
+		parent = traceContext{sampled: true}
+		rand.Read(parent.traceID[:])
+	}
+	ctx, s := cs.newSpan(ctx, spanRequest, parent, ok)
+	s.set("http.request.method", r.Method)
+	s.set("url.path", r.URL.Path)
+	return ctx, s
+}
+
+// startSpan starts a span as a child of the span in ctx, or a new trace if
+// there is none.
+func (cs *CacheServer) startSpan(ctx context.Context, name string) (context.Context, *span) {
+	if cs.spanExporter == nil {
+		return ctx, nil
+	}
+	if parent := spanFrom(ctx); parent != nil {
+		return cs.newSpan(ctx, name, parent.tc, true)
+	}
+	parent := traceContext{sampled: true}
+	rand.Read(parent.traceID[:])
+	return cs.newSpan(ctx, name, parent, false)
+}
+
+func (cs *CacheServer) newSpan(ctx context.Context, name string, parent traceContext, hasParent bool) (context.Context, *span) {
+	s := &span{exporter: cs.spanExporter, tc: parent}
+	rand.Read(s.tc.spanID[:])
+	s.data = Span{
+		TraceID: hex.EncodeToString(s.tc.traceID[:]),
+		SpanID:  hex.EncodeToString(s.tc.spanID[:]),
+		Name:    name,
+		Start:   time.Now(),
+	}
+	if hasParent {
+		s.data.ParentID = hex.EncodeToString(parent.spanID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *span) set(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]any)
+	}
+	s.data.Attributes[key] = value
+}
+
+func (s *span) event(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Events = append(s.data.Events, SpanEvent{Name: name, Time: time.Now()})
+}
+
+// end exports s unless its trace is not sampled. Only the first call
+// counts.
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+	if s.tc.sampled {
+		s.exporter.ExportSpan(data)
+	}
+}
+
+// traceOrigin records the connection timings of an origin fetch as events
+// of s.
+func traceOrigin(ctx context.Context, s *span) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			s.set("network.connection.reused", info.Reused)
+		},
+		DNSStart:             func(httptrace.DNSStartInfo) { s.event("dns_start") },
+		DNSDone:              func(httptrace.DNSDoneInfo) { s.event("dns_done") },
+		ConnectStart:         func(string, string) { s.event("connect_start") },
+		ConnectDone:          func(string, string, error) { s.event("connect_done") },
+		TLSHandshakeStart:    func() { s.event("tls_start") },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { s.event("tls_done") },
+		GotFirstResponseByte: func() { s.event("first_byte") },
+	})
+}
+
+// endRequest ends the span of a request with the cache result of ex.
+func (s *span) endRequest(ex *exchange) {
+	if s == nil {
+		return
+	}
+	if ex.result != "" {
+		s.set("cache.result", ex.result)
+	}
+	s.end()
+}
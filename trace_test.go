@@ -0,0 +1,122 @@
+package kyache
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func decodeSpans(t *testing.T, buf *bytes.Buffer) []Span {
+	t.Helper()
+	var spans []Span
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var s Span
+		if err := dec.Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		spans = append(spans, s)
+	}
+	return spans
+}
+
+func TestTracingSpansAndPropagation(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	var traceparent, tracestate string
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		traceparent, tracestate = r.Header.Get("Traceparent"), r.Header.Get("Tracestate")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("body"))
+	})
+	var buf bytes.Buffer
+	handler := New(&Config{SpanExporter: NewJSONSpanExporter(&buf)}).Handler(originURL)
+	for range 2 {
+		req := httptest.NewRequest("GET", "/obj", nil)
+		req.Header.Set("Traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		req.Header.Set("Tracestate", "congo=t61rcWkgMzE")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	spans := decodeSpans(t, &buf)
+	var names []string
+	for _, s := range spans {
+		names = append(names, s.Name)
+		if s.TraceID != traceID {
+			t.Errorf("span %s is in trace %s, want %s", s.Name, s.TraceID, traceID)
+		}
+	}
+	want := "kyache.lookup kyache.origin_fetch kyache.store kyache.request kyache.lookup kyache.request"
+	if got := strings.Join(names, " "); got != want {
+		t.Fatalf("spans = %s, want %s", got, want)
+	}
+	lookup, fetch, store, request := spans[0], spans[1], spans[2], spans[3]
+	if request.ParentID != "00f067aa0ba902b7" || request.Attributes["cache.result"] != "MISS" {
+		t.Errorf("request span = %+v", request)
+	}
+	for _, s := range []Span{lookup, fetch, store} {
+		if s.ParentID != request.SpanID {
+			t.Errorf("span %s has parent %s, want the request span %s", s.Name, s.ParentID, request.SpanID)
+		}
+	}
+	if lookup.Attributes["cache.fwd"] != "uri-miss" || spans[4].Attributes["cache.fwd"] != "" {
+		t.Errorf("lookup spans = %+v, %+v", lookup, spans[4])
+	}
+	if traceparent != "00-"+traceID+"-"+fetch.SpanID+"-01" || tracestate != "congo=t61rcWkgMzE" {
+		t.Errorf("origin got traceparent %q and tracestate %q", traceparent, tracestate)
+	}
+	events := make(map[string]bool)
+	for _, e := range fetch.Events {
+		events[e.Name] = true
+	}
+	if !events["connect_done"] || !events["first_byte"] || fetch.Attributes["http.response.status_code"] != 200.0 {
+		t.Errorf("origin fetch span = %+v", fetch)
+	}
+	if store.Attributes["cache.store_reason"] != "fill" {
+		t.Errorf("store span = %+v", store)
+	}
+}
+
+func TestTracingUnsampledIsPropagatedOnly(t *testing.T) {
+	var traceparent string
+	originURL := newTestOrigin(t, func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+	})
+	var buf bytes.Buffer
+	handler := New(&Config{SpanExporter: NewJSONSpanExporter(&buf)}).Handler(originURL)
+	req := httptest.NewRequest("GET", "/obj", nil)
+	req.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if buf.Len() != 0 {
+		t.Errorf("exported unsampled spans: %s", buf.String())
+	}
+	if !strings.HasPrefix(traceparent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || !strings.HasSuffix(traceparent, "-00") ||
+		strings.Contains(traceparent, "00f067aa0ba902b7") {
+		t.Errorf("origin got traceparent %q", traceparent)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01", false},
+		{"garbage", false},
+	}
+	for _, tt := range tests {
+		_, ok := parseTraceparent(http.Header{"Traceparent": {tt.value}})
+		if ok != tt.ok {
+			t.Errorf("parseTraceparent(%q) ok = %v, want %v", tt.value, ok, tt.ok)
+		}
+	}
+}